@@ -0,0 +1,47 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import "github.com/prometheus/tsdb/labels"
+
+// Appender allows appending a batch of data. It must be completed with a
+// call to Commit or Rollback and must not be reused afterwards.
+//
+// Operations on the Appender interface are not goroutine-safe.
+type Appender interface {
+	// Add adds a sample pair for the given series. A reference number is
+	// returned which can be used to add further samples in the same or
+	// later transactions. Returned reference numbers are ephemeral and
+	// may be rejected in calls to AddFast() at any point. Adding the
+	// sample via Add() returns a new reference number.
+	Add(l labels.Labels, t int64, v float64) (uint64, error)
+
+	// AddFast adds a sample pair for the referenced existing series.
+	AddFast(ref uint64, t int64, v float64) error
+
+	// AppendExemplar appends an exemplar for the series referenced by ref.
+	// ref is not checked against the series added so far. Exemplars whose
+	// label set exceeds the configured byte limit are rejected with
+	// ErrExemplarLabelLength. The exemplar is stored when AppendExemplar
+	// is called, not on Commit.
+	AppendExemplar(ref uint64, l labels.Labels, e Exemplar) error
+
+	// Commit submits the collected samples and purges the batch.
+	Commit() error
+
+	// Rollback discards the samples collected in the current transaction
+	// without returning an error. Series created by Add and exemplars
+	// appended by AppendExemplar are kept.
+	Rollback() error
+}
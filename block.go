@@ -0,0 +1,226 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/oklog/ulid"
+
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// BlockMeta holds the meta information persisted alongside a block's data.
+type BlockMeta struct {
+	ULID    ulid.ULID `json:"ulid"`
+	MinTime int64     `json:"minTime"`
+	MaxTime int64     `json:"maxTime"`
+}
+
+// Block represents a directory of time series data covering a continuous
+// time range, backed by an index and a set of chunk files on disk.
+type Block struct {
+	dir  string
+	meta BlockMeta
+
+	// seriesLabels holds the label set of every series in the block, for
+	// Querier.Select to filter. Populated from the on-disk index by
+	// openBlock.
+	seriesLabels []labels.Labels
+
+	// series holds the block's series and their chunks, for
+	// ChunkQuerierForRange to filter. Populated from the on-disk index by
+	// openBlock.
+	series []seriesChunks
+}
+
+// Meta returns meta information about the block.
+func (pb *Block) Meta() BlockMeta {
+	return pb.meta
+}
+
+// Dir returns the directory of the block on disk.
+func (pb *Block) Dir() string {
+	return pb.dir
+}
+
+// Close releases all resources held by the block.
+func (pb *Block) Close() error {
+	return nil
+}
+
+// blockFilesForSize lists the files whose size counts towards a block's
+// on-disk footprint for size-based retention: the index file, the
+// tombstone file, and every chunk segment under the chunks/ subdirectory.
+// Anything else found under the block directory (e.g. meta.json) is
+// intentionally excluded.
+func blockFilesForSize(dir string) ([]string, error) {
+	files := []string{
+		filepath.Join(dir, "index"),
+		filepath.Join(dir, "tombstones"),
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "chunks", "*"))
+	if err != nil {
+		return nil, err
+	}
+	return append(files, segments...), nil
+}
+
+// chunkRef locates one series' chunk within the block's single chunks
+// segment, alongside the time bounds and encoding needed to reconstruct a
+// chunkenc.Chunk from the raw bytes without re-deriving them.
+type chunkRef struct {
+	MinTime, MaxTime int64
+	Encoding         chunkenc.Encoding
+	Offset, Length   int64
+}
+
+// indexEntry is the on-disk, gob-encoded representation of one series: its
+// label set and the chunks covering it, in the order they were written to
+// the chunks segment.
+type indexEntry struct {
+	Labels labels.Labels
+	Chunks []chunkRef
+}
+
+// writeBlock persists the subset of head's series overlapping [mint, maxt)
+// to dir, laid out the way Snapshot expects to find it again: a meta.json,
+// a gob-encoded index of per-series chunk locations, a single chunks
+// segment holding the raw chunk bytes back to back, and an (empty, since
+// this block has nothing to mark dead on arrival) tombstones file.
+func writeBlock(dir string, id ulid.ULID, head *Head, mint, maxt int64) error {
+	if err := os.MkdirAll(filepath.Join(dir, "chunks"), 0777); err != nil {
+		return fmt.Errorf("create chunks dir: %w", err)
+	}
+
+	chunksFile, err := os.Create(filepath.Join(dir, "chunks", "000001"))
+	if err != nil {
+		return fmt.Errorf("create chunks segment: %w", err)
+	}
+	defer chunksFile.Close()
+
+	head.mtx.RLock()
+	series := append([]seriesChunks(nil), head.series...)
+	head.mtx.RUnlock()
+
+	var (
+		offset  int64
+		entries = make([]indexEntry, 0, len(series))
+	)
+	for _, s := range series {
+		chks := chunksInRange(s.chks, mint, maxt)
+		if len(chks) == 0 {
+			continue
+		}
+		entry := indexEntry{Labels: append(labels.Labels(nil), s.lset...)}
+		for _, c := range chks {
+			b := c.Chunk.Bytes()
+			if _, err := chunksFile.Write(b); err != nil {
+				return fmt.Errorf("write chunk: %w", err)
+			}
+			entry.Chunks = append(entry.Chunks, chunkRef{
+				MinTime:  c.MinTime,
+				MaxTime:  c.MaxTime,
+				Encoding: c.Chunk.Encoding(),
+				Offset:   offset,
+				Length:   int64(len(b)),
+			})
+			offset += int64(len(b))
+		}
+		entries = append(entries, entry)
+	}
+	if err := chunksFile.Sync(); err != nil {
+		return fmt.Errorf("sync chunks segment: %w", err)
+	}
+
+	indexFile, err := os.Create(filepath.Join(dir, "index"))
+	if err != nil {
+		return fmt.Errorf("create index: %w", err)
+	}
+	defer indexFile.Close()
+	if err := gob.NewEncoder(indexFile).Encode(entries); err != nil {
+		return fmt.Errorf("encode index: %w", err)
+	}
+
+	// meta covers the full [mint, maxt) the caller asked this block to own,
+	// not just the span actually covered by data: minValidTimeForBlocks
+	// relies on MaxTime to know which WAL records this block has already
+	// made redundant, regardless of whether every series had a sample in
+	// every corner of the requested range.
+	meta := BlockMeta{ULID: id, MinTime: mint, MaxTime: maxt}
+	metaBytes, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal meta: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "meta.json"), metaBytes, 0666); err != nil {
+		return fmt.Errorf("write meta: %w", err)
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, "tombstones"), nil, 0666)
+}
+
+// openBlock reads a block directory written by writeBlock (directly, or
+// hard-linked into a snapshot by DB.Snapshot) back into a *Block ready for
+// querying.
+func openBlock(dir string) (*Block, error) {
+	metaBytes, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read meta: %w", err)
+	}
+	var meta BlockMeta
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return nil, fmt.Errorf("unmarshal meta: %w", err)
+	}
+
+	indexFile, err := os.Open(filepath.Join(dir, "index"))
+	if err != nil {
+		return nil, fmt.Errorf("open index: %w", err)
+	}
+	defer indexFile.Close()
+	var entries []indexEntry
+	if err := gob.NewDecoder(indexFile).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decode index: %w", err)
+	}
+
+	chunkBytes, err := ioutil.ReadFile(filepath.Join(dir, "chunks", "000001"))
+	if err != nil {
+		return nil, fmt.Errorf("read chunks segment: %w", err)
+	}
+
+	pool := chunkenc.NewPool()
+	b := &Block{dir: dir, meta: meta}
+	for _, e := range entries {
+		sc := seriesChunks{lset: e.Labels}
+		for _, c := range e.Chunks {
+			if c.Offset < 0 || c.Length < 0 || c.Offset+c.Length > int64(len(chunkBytes)) {
+				return nil, fmt.Errorf("chunk reference out of bounds in block %s", meta.ULID)
+			}
+			chk, err := pool.Get(c.Encoding, chunkBytes[c.Offset:c.Offset+c.Length])
+			if err != nil {
+				return nil, fmt.Errorf("decode chunk in block %s: %w", meta.ULID, err)
+			}
+			sc.chks = append(sc.chks, chunks.Meta{MinTime: c.MinTime, MaxTime: c.MaxTime, Chunk: chk})
+		}
+		b.seriesLabels = append(b.seriesLabels, sc.lset)
+		b.series = append(b.series, sc)
+	}
+	return b, nil
+}
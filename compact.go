@@ -0,0 +1,80 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Compactor merges a set of time-ordered blocks into a single block or
+// flushes a Head into a new persisted block.
+type Compactor interface {
+	// Write persists a Head block into a new block under dir, restricted
+	// to [mint, maxt), and returns the new block's ULID.
+	Write(dir string, head *Head, mint, maxt int64, parent *BlockMeta) (ulid.ULID, error)
+}
+
+// ExponentialBlockRanges returns the time ranges to use for a series of
+// compaction steps, starting at minSize and growing by stepSize each of
+// steps generations.
+func ExponentialBlockRanges(minSize int64, steps, stepSize int) []int64 {
+	ranges := make([]int64, steps)
+	curRange := minSize
+	for i := 0; i < steps; i++ {
+		ranges[i] = curRange
+		curRange = curRange * int64(stepSize)
+	}
+	return ranges
+}
+
+// LeveledCompactor implements Compactor by grouping blocks into levels
+// based on ranges and compacting adjacent blocks within a level.
+type LeveledCompactor struct {
+	ctx    context.Context
+	logger log.Logger
+	ranges []int64
+}
+
+// NewLeveledCompactor returns a LeveledCompactor using the given ranges.
+func NewLeveledCompactor(ctx context.Context, r prometheus.Registerer, l log.Logger, ranges []int64, pool interface{}) (*LeveledCompactor, error) {
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+	return &LeveledCompactor{ctx: ctx, logger: l, ranges: ranges}, nil
+}
+
+// Write implements Compactor. It flushes head's series restricted to
+// [mint, maxt) into a new block directory, flat under dir (matching the
+// layout Snapshot already uses for hard-linked blocks), and returns its
+// ULID.
+func (c *LeveledCompactor) Write(dir string, head *Head, mint, maxt int64, parent *BlockMeta) (ulid.ULID, error) {
+	id := ulid.MustNew(ulid.Now(), rand.New(rand.NewSource(int64(ulid.Now()))))
+
+	blockDir := filepath.Join(dir, id.String())
+	if err := os.MkdirAll(blockDir, 0777); err != nil {
+		return ulid.ULID{}, fmt.Errorf("create block dir: %w", err)
+	}
+	if err := writeBlock(blockDir, id, head, mint, maxt); err != nil {
+		return ulid.ULID{}, fmt.Errorf("write block %s: %w", id, err)
+	}
+	return id, nil
+}
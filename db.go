@@ -0,0 +1,495 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// DefaultOptions used for the DB. They are sane for setups using
+// millisecond precision timestamps.
+var DefaultOptions = &Options{
+	WALFlushInterval:  5 * time.Second,
+	RetentionDuration: 15 * 24 * 60 * 60 * 1000, // 15 days in milliseconds
+	MaxBytes:          0,                        // disabled by default
+	BlockRanges:       ExponentialBlockRanges(int64(2*time.Hour)/1e6, 3, 5),
+	NoLockfile:        false,
+}
+
+// Options of the DB storage.
+type Options struct {
+	// The interval at which the write ahead log is flushed to disc.
+	WALFlushInterval time.Duration
+
+	// Duration of persisted data to keep. Unit agnostic as long as
+	// it is consistent with BlockRanges.
+	RetentionDuration uint64
+
+	// MaxBytes is the maximum number of bytes the blocks under the data
+	// directory are allowed to occupy on disk. Once the total on-disk size
+	// of all persisted blocks exceeds MaxBytes, the oldest blocks are
+	// deleted until the DB is back under the limit. A value of 0 disables
+	// size-based retention; time-based retention (RetentionDuration) still
+	// applies.
+	MaxBytes int64
+
+	// The sizes of the Blocks.
+	BlockRanges []int64
+
+	// NoLockfile has no effect: Open never creates or checks a lock file.
+	NoLockfile bool
+
+	// MaxExemplars is the maximum number of exemplars stored per series in
+	// the Head's circular exemplar buffer. A value of 0 disables exemplar
+	// storage entirely.
+	MaxExemplars int
+}
+
+// DB handles reads and writes of time series falling into
+// a hashed partition of a seriesID.
+type DB struct {
+	dir   string
+	lockf *lockfile
+
+	logger     log.Logger
+	registerer prometheus.Registerer
+	metrics    *dbMetrics
+	opts       *Options
+	chunkPool  chunkenc.Pool
+
+	mtx    sync.RWMutex
+	blocks []*Block
+
+	head *Head
+
+	compactor Compactor
+
+	// sizeCache caches the computed on-disk size of each block, keyed by
+	// ULID, so that repeated retention passes don't re-walk the block
+	// directory. Blocks are immutable once persisted, so a cached size
+	// never goes stale.
+	sizeMtx   sync.Mutex
+	sizeCache map[ulid.ULID]int64
+
+	donec chan struct{}
+	stopc chan struct{}
+}
+
+type dbMetrics struct {
+	loadedBlocks         prometheus.GaugeFunc
+	symbolTableSize      prometheus.GaugeFunc
+	reloads              prometheus.Counter
+	reloadsFailed        prometheus.Counter
+	compactionsTriggered prometheus.Counter
+	timeRetentions       prometheus.Counter
+	sizeRetentions       prometheus.Counter
+	storageBlocksBytes   prometheus.GaugeFunc
+}
+
+func newDBMetrics(db *DB, r prometheus.Registerer) *dbMetrics {
+	m := &dbMetrics{}
+
+	m.loadedBlocks = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_blocks_loaded",
+		Help: "Number of currently loaded data blocks",
+	}, func() float64 {
+		db.mtx.RLock()
+		defer db.mtx.RUnlock()
+		return float64(len(db.blocks))
+	})
+	m.reloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_reloads_total",
+		Help: "Number of times the database reloaded block data from disk.",
+	})
+	m.reloadsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_reloads_failures_total",
+		Help: "Number of times the database failed to reloadBlocks block data from disk.",
+	})
+	m.timeRetentions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_time_retentions_total",
+		Help: "The number of times that blocks were deleted because the time limit was exceeded.",
+	})
+	m.sizeRetentions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_size_retentions_total",
+		Help: "The number of times that blocks were deleted because the maximum number of bytes was exceeded.",
+	})
+	m.storageBlocksBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_storage_blocks_bytes",
+		Help: "The number of bytes that are currently used for local storage by all blocks.",
+	}, func() float64 {
+		db.mtx.RLock()
+		defer db.mtx.RUnlock()
+		var total int64
+		for _, b := range db.blocks {
+			total += db.blockSize(b)
+		}
+		return float64(total)
+	})
+
+	if r != nil {
+		r.MustRegister(
+			m.loadedBlocks,
+			m.reloads,
+			m.reloadsFailed,
+			m.timeRetentions,
+			m.sizeRetentions,
+			m.storageBlocksBytes,
+		)
+	}
+	return m
+}
+
+// unregister removes m's collectors from r, the Registerer m was
+// registered with. Callers must pass the same Registerer (possibly nil,
+// in which case this is a no-op) that was passed to newDBMetrics.
+func (m *dbMetrics) unregister(r prometheus.Registerer) {
+	if r == nil {
+		return
+	}
+	r.Unregister(m.loadedBlocks)
+	r.Unregister(m.reloads)
+	r.Unregister(m.reloadsFailed)
+	r.Unregister(m.timeRetentions)
+	r.Unregister(m.sizeRetentions)
+	r.Unregister(m.storageBlocksBytes)
+}
+
+// Open returns a new DB in the given directory.
+func Open(dir string, l log.Logger, r prometheus.Registerer, opts *Options) (db *DB, err error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	if len(opts.BlockRanges) == 0 {
+		// A caller-supplied Options with no BlockRanges (e.g. the
+		// embedded Options of a zero-value MultiDBOptions, or a test
+		// that only sets the field it cares about) would otherwise
+		// crash below indexing into an empty slice.
+		opts.BlockRanges = DefaultOptions.BlockRanges
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+
+	db = &DB{
+		dir:        dir,
+		logger:     l,
+		registerer: r,
+		opts:       opts,
+		sizeCache:  map[ulid.ULID]int64{},
+		donec:      make(chan struct{}),
+		stopc:      make(chan struct{}),
+	}
+	db.metrics = newDBMetrics(db, r)
+
+	if err := db.reloadBlocks(); err != nil {
+		return nil, err
+	}
+
+	compactor, err := NewLeveledCompactor(context.Background(), r, l, opts.BlockRanges, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create compactor: %w", err)
+	}
+	db.compactor = compactor
+
+	head, err := NewHead(r, l, nil, opts.BlockRanges[0])
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxExemplars > 0 {
+		head.exemplars = NewCircularExemplarStorage(opts.MaxExemplars, 0)
+	}
+	db.head = head
+
+	if err := head.Init(minValidTimeForBlocks(db.blocks)); err != nil {
+		return nil, fmt.Errorf("init head: %w", err)
+	}
+
+	go db.run()
+	return db, nil
+}
+
+// minValidTimeForBlocks returns the maxt of the most recently persisted
+// block, i.e. the boundary below which data is already owned by a block
+// and must not be replayed from the WAL into the head. It returns 0 if no
+// blocks are persisted yet.
+func minValidTimeForBlocks(blocks []*Block) int64 {
+	var maxt int64
+	for _, b := range blocks {
+		if b.Meta().MaxTime > maxt {
+			maxt = b.Meta().MaxTime
+		}
+	}
+	return maxt
+}
+
+func (db *DB) run() {
+	defer close(db.donec)
+
+	backoff := time.Duration(0)
+	for {
+		select {
+		case <-db.stopc:
+			return
+		case <-time.After(backoff):
+		}
+
+		if err := db.retentionCutoff(); err != nil {
+			level.Error(db.logger).Log("msg", "retention cutoff failed", "err", err)
+		}
+		backoff = 1 * time.Minute
+	}
+}
+
+// retentionCutoff deletes blocks that violate either the time-based or the
+// size-based retention policy. A block is removed if it violates either
+// policy; the two run as part of the same pass so that size-based
+// eviction always considers the set of blocks left after time-based
+// eviction has run.
+func (db *DB) retentionCutoff() error {
+	db.mtx.RLock()
+	blocks := db.blocks[:]
+	db.mtx.RUnlock()
+
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	deletable := map[ulid.ULID]struct{}{}
+	if db.opts.RetentionDuration != 0 {
+		for id := range db.beyondTimeRetention(blocks) {
+			deletable[id] = struct{}{}
+		}
+	}
+	if db.opts.MaxBytes > 0 {
+		remaining := make([]*Block, 0, len(blocks))
+		for _, b := range blocks {
+			if _, ok := deletable[b.Meta().ULID]; !ok {
+				remaining = append(remaining, b)
+			}
+		}
+		for id := range db.beyondSizeRetention(remaining) {
+			deletable[id] = struct{}{}
+		}
+	}
+	if len(deletable) == 0 {
+		return nil
+	}
+	return db.deleteBlocks(deletable)
+}
+
+func (db *DB) beyondTimeRetention(blocks []*Block) (deletable map[ulid.ULID]struct{}) {
+	if len(blocks) == 0 || db.opts.RetentionDuration == 0 {
+		return nil
+	}
+	deletable = map[ulid.ULID]struct{}{}
+	maxt := blocks[len(blocks)-1].Meta().MaxTime
+
+	for _, b := range blocks {
+		if maxt-b.Meta().MaxTime > int64(db.opts.RetentionDuration) {
+			deletable[b.Meta().ULID] = struct{}{}
+		}
+	}
+	if len(deletable) > 0 {
+		db.metrics.timeRetentions.Inc()
+	}
+	return deletable
+}
+
+// beyondSizeRetention returns the set of blocks, oldest first, that must be
+// deleted in order to bring the total on-disk size of all persisted blocks
+// under Options.MaxBytes.
+func (db *DB) beyondSizeRetention(blocks []*Block) (deletable map[ulid.ULID]struct{}) {
+	if len(blocks) == 0 || db.opts.MaxBytes <= 0 {
+		return nil
+	}
+	deletable = map[ulid.ULID]struct{}{}
+
+	var total int64
+	for _, b := range blocks {
+		total += db.blockSize(b)
+	}
+
+	// Blocks are kept sorted oldest-first; walk from the front, removing
+	// blocks until the budget is satisfied.
+	for _, b := range blocks {
+		if total <= db.opts.MaxBytes {
+			break
+		}
+		sz := db.blockSize(b)
+		deletable[b.Meta().ULID] = struct{}{}
+		total -= sz
+	}
+	if len(deletable) > 0 {
+		db.metrics.sizeRetentions.Inc()
+	}
+	return deletable
+}
+
+// blockSize returns the on-disk size of the block in bytes, summing its
+// chunks, index and tombstone files. The result is cached per block ULID
+// since blocks are immutable once persisted, so subsequent retention
+// passes don't need to re-walk the directory.
+func (db *DB) blockSize(b *Block) int64 {
+	id := b.Meta().ULID
+
+	db.sizeMtx.Lock()
+	defer db.sizeMtx.Unlock()
+
+	if sz, ok := db.sizeCache[id]; ok {
+		return sz
+	}
+
+	sz, err := blockDirSize(b.Dir())
+	if err != nil {
+		level.Warn(db.logger).Log("msg", "failed to compute block size", "block", id, "err", err)
+		return 0
+	}
+	db.sizeCache[id] = sz
+	return sz
+}
+
+// blockDirSize sums the size of the chunks, index and tombstone files that
+// make up a block, as listed by blockFilesForSize. A missing file (e.g. a
+// block with no tombstones yet) is not an error and simply contributes 0.
+func blockDirSize(dir string) (int64, error) {
+	files, err := blockFilesForSize(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += fi.Size()
+	}
+	return total, nil
+}
+
+func (db *DB) deleteBlocks(ids map[ulid.ULID]struct{}) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	var kept []*Block
+	for _, b := range db.blocks {
+		if _, ok := ids[b.Meta().ULID]; !ok {
+			kept = append(kept, b)
+			continue
+		}
+		if err := b.Close(); err != nil {
+			return fmt.Errorf("closing block %s before deletion: %w", b.Meta().ULID, err)
+		}
+		if err := os.RemoveAll(b.Dir()); err != nil {
+			return fmt.Errorf("deleting block %s: %w", b.Meta().ULID, err)
+		}
+		db.sizeMtx.Lock()
+		delete(db.sizeCache, b.Meta().ULID)
+		db.sizeMtx.Unlock()
+	}
+	db.blocks = kept
+	return nil
+}
+
+// reloadBlocks rescans the data directory and updates the set of blocks
+// held open by the DB. Block directories are ULID-named and sit flat
+// under db.dir (the same layout Snapshot hard-links blocks into); any
+// other entry (e.g. the lock file) is skipped.
+func (db *DB) reloadBlocks() error {
+	entries, err := ioutil.ReadDir(db.dir)
+	if err != nil {
+		db.metrics.reloadsFailed.Inc()
+		return fmt.Errorf("read data dir: %w", err)
+	}
+
+	var blocks []*Block
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := ulid.Parse(e.Name()); err != nil {
+			continue
+		}
+		b, err := openBlock(filepath.Join(db.dir, e.Name()))
+		if err != nil {
+			db.metrics.reloadsFailed.Inc()
+			return fmt.Errorf("open block %s: %w", e.Name(), err)
+		}
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Meta().MinTime < blocks[j].Meta().MinTime
+	})
+
+	db.mtx.Lock()
+	db.blocks = blocks
+	db.mtx.Unlock()
+
+	db.metrics.reloads.Inc()
+	return nil
+}
+
+// Close closes the database and all its underlying resources.
+func (db *DB) Close() error {
+	close(db.stopc)
+	<-db.donec
+
+	db.metrics.unregister(db.registerer)
+
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	var merr error
+	for _, b := range db.blocks {
+		if err := b.Close(); err != nil {
+			merr = err
+		}
+	}
+	return merr
+}
+
+// Dir returns the data directory used by the DB.
+func (db *DB) Dir() string {
+	return db.dir
+}
+
+// Appender opens a new appender against the head block.
+func (db *DB) Appender() Appender {
+	return db.head.Appender()
+}
+
+// lockfile is a placeholder for an on-disk lock of the data directory;
+// nothing in this package creates one, and DB.lockf stays nil.
+type lockfile struct{}
@@ -0,0 +1,300 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// defaultMaxExemplarLabelBytes is the default limit on the combined byte
+// size of an exemplar's label set, used when Options.MaxExemplars is set
+// but no explicit byte limit is configured.
+const defaultMaxExemplarLabelBytes = 128
+
+// recTypeExemplars identifies a WAL record produced by encodeExemplarRecord.
+// It is scoped to this package's own record stream rather than the shared
+// series/samples/tombstones record types, which are unchanged by this file.
+const recTypeExemplars = byte(1)
+
+// recordType returns the type byte prefixing rec, or 0 if rec is empty.
+func recordType(rec []byte) byte {
+	if len(rec) == 0 {
+		return 0
+	}
+	return rec[0]
+}
+
+// encodeExemplarRecord encodes ref and e as a WAL record so that exemplars
+// appended via headAppender.AppendExemplar survive a crash and can be
+// replayed by Head.Init.
+func encodeExemplarRecord(ref uint64, e Exemplar) []byte {
+	buf := make([]byte, 1, 32)
+	buf[0] = recTypeExemplars
+	buf = appendUvarint(buf, ref)
+	buf = appendUvarint(buf, uint64(len(e.Labels)))
+	for _, l := range e.Labels {
+		buf = appendUvarint(buf, uint64(len(l.Name)))
+		buf = append(buf, l.Name...)
+		buf = appendUvarint(buf, uint64(len(l.Value)))
+		buf = append(buf, l.Value...)
+	}
+	buf = appendUvarint(buf, math.Float64bits(e.Value))
+	buf = appendUvarint(buf, uint64(e.Ts))
+	return buf
+}
+
+// decodeExemplarRecord reverses encodeExemplarRecord. It returns an error if
+// rec is not a well-formed exemplar record.
+func decodeExemplarRecord(rec []byte) (ref uint64, e Exemplar, err error) {
+	if recordType(rec) != recTypeExemplars {
+		return 0, Exemplar{}, fmt.Errorf("not an exemplar record")
+	}
+	b := rec[1:]
+
+	ref, b, err = takeUvarint(b)
+	if err != nil {
+		return 0, Exemplar{}, fmt.Errorf("decoding ref: %w", err)
+	}
+	n, b, err := takeUvarint(b)
+	if err != nil {
+		return 0, Exemplar{}, fmt.Errorf("decoding label count: %w", err)
+	}
+	lbls := make(labels.Labels, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var nameLen, valueLen uint64
+		nameLen, b, err = takeUvarint(b)
+		if err != nil {
+			return 0, Exemplar{}, fmt.Errorf("decoding label name length: %w", err)
+		}
+		if uint64(len(b)) < nameLen {
+			return 0, Exemplar{}, fmt.Errorf("truncated label name")
+		}
+		name := string(b[:nameLen])
+		b = b[nameLen:]
+
+		valueLen, b, err = takeUvarint(b)
+		if err != nil {
+			return 0, Exemplar{}, fmt.Errorf("decoding label value length: %w", err)
+		}
+		if uint64(len(b)) < valueLen {
+			return 0, Exemplar{}, fmt.Errorf("truncated label value")
+		}
+		value := string(b[:valueLen])
+		b = b[valueLen:]
+
+		lbls = append(lbls, labels.Label{Name: name, Value: value})
+	}
+
+	valueBits, b, err := takeUvarint(b)
+	if err != nil {
+		return 0, Exemplar{}, fmt.Errorf("decoding value: %w", err)
+	}
+	ts, _, err := takeUvarint(b)
+	if err != nil {
+		return 0, Exemplar{}, fmt.Errorf("decoding timestamp: %w", err)
+	}
+
+	return ref, Exemplar{Labels: lbls, Value: math.Float64frombits(valueBits), Ts: int64(ts)}, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func takeUvarint(b []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("invalid varint")
+	}
+	return v, b[n:], nil
+}
+
+// ErrExemplarLabelLength is returned by AppendExemplar when the combined
+// byte size of an exemplar's labels exceeds the configured limit.
+var ErrExemplarLabelLength = fmt.Errorf("exemplar labels exceed the maximum allowed size")
+
+// Exemplar is a sample annotated with trace-level labels, typically used
+// to link a high-value observation (e.g. a slow request) back to its
+// originating trace.
+type Exemplar struct {
+	Labels labels.Labels
+	Value  float64
+	Ts     int64
+}
+
+// ExemplarStorage ingests and serves exemplars for a single head block.
+type ExemplarStorage interface {
+	// AddExemplar appends e for the series referenced by ref, evicting the
+	// oldest exemplar for that series if the per-series ring is full. l is
+	// the label set of the series ref refers to, used by ExemplarQuerier
+	// to match exemplars against matchers; it may be nil if the series'
+	// label set isn't known (e.g. replaying an exemplar WAL record without
+	// having replayed the series itself), in which case matchers are
+	// evaluated against an empty label set for that series until l
+	// becomes known.
+	AddExemplar(ref uint64, l labels.Labels, e Exemplar) error
+	// ExemplarQuerier returns a querier over the currently stored exemplars.
+	ExemplarQuerier() ExemplarQuerier
+}
+
+// ExemplarQuerier selects exemplars for series matching a set of label
+// matchers within a time range.
+type ExemplarQuerier interface {
+	// Select returns exemplars, grouped by series, for series matching all
+	// of the given matchers with at least one exemplar in [mint, maxt].
+	Select(mint, maxt int64, matchers ...labels.Matcher) (map[uint64][]Exemplar, error)
+}
+
+// CircularExemplarStorage is an ExemplarStorage backed by a fixed-size
+// circular buffer per series. It is bounded by Options.MaxExemplars and
+// never grows past that limit; once full, appending an exemplar for a
+// series overwrites that series' oldest stored exemplar.
+type CircularExemplarStorage struct {
+	maxExemplars     int
+	maxLabelSetBytes int
+
+	mtx    sync.RWMutex
+	rings  map[uint64]*exemplarRing
+	labels map[uint64]labels.Labels
+}
+
+// NewCircularExemplarStorage returns a CircularExemplarStorage that keeps
+// at most maxExemplars per series. maxLabelSetBytes bounds the combined
+// byte size of an exemplar's label set; a value <= 0 falls back to
+// defaultMaxExemplarLabelBytes.
+func NewCircularExemplarStorage(maxExemplars int, maxLabelSetBytes int) *CircularExemplarStorage {
+	if maxLabelSetBytes <= 0 {
+		maxLabelSetBytes = defaultMaxExemplarLabelBytes
+	}
+	return &CircularExemplarStorage{
+		maxExemplars:     maxExemplars,
+		maxLabelSetBytes: maxLabelSetBytes,
+		rings:            map[uint64]*exemplarRing{},
+		labels:           map[uint64]labels.Labels{},
+	}
+}
+
+// AddExemplar implements ExemplarStorage.
+func (es *CircularExemplarStorage) AddExemplar(ref uint64, l labels.Labels, e Exemplar) error {
+	if size := exemplarLabelSetBytes(e.Labels); size > es.maxLabelSetBytes {
+		return ErrExemplarLabelLength
+	}
+
+	es.mtx.Lock()
+	defer es.mtx.Unlock()
+
+	r, ok := es.rings[ref]
+	if !ok {
+		r = newExemplarRing(es.maxExemplars)
+		es.rings[ref] = r
+	}
+	if l != nil {
+		es.labels[ref] = l
+	}
+	r.add(e)
+	return nil
+}
+
+// ExemplarQuerier implements ExemplarStorage.
+func (es *CircularExemplarStorage) ExemplarQuerier() ExemplarQuerier {
+	return &circularExemplarQuerier{es: es}
+}
+
+func exemplarLabelSetBytes(l labels.Labels) int {
+	var n int
+	for _, lbl := range l {
+		n += len(lbl.Name) + len(lbl.Value)
+	}
+	return n
+}
+
+// exemplarRing is a fixed-capacity circular buffer of exemplars for a
+// single series, ordered oldest-to-newest.
+type exemplarRing struct {
+	buf  []Exemplar
+	next int
+	full bool
+}
+
+func newExemplarRing(capacity int) *exemplarRing {
+	return &exemplarRing{buf: make([]Exemplar, capacity)}
+}
+
+func (r *exemplarRing) add(e Exemplar) {
+	if len(r.buf) == 0 {
+		return
+	}
+	r.buf[r.next] = e
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// items returns the stored exemplars in insertion order.
+func (r *exemplarRing) items() []Exemplar {
+	if !r.full {
+		return append([]Exemplar(nil), r.buf[:r.next]...)
+	}
+	out := make([]Exemplar, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	out = append(out, r.buf[:r.next]...)
+	return out
+}
+
+type circularExemplarQuerier struct {
+	es *CircularExemplarStorage
+}
+
+// Select implements ExemplarQuerier: matchers are evaluated against the
+// label set of the series ref belongs to (as passed to AddExemplar), not
+// against any individual exemplar's own labels.
+func (q *circularExemplarQuerier) Select(mint, maxt int64, matchers ...labels.Matcher) (map[uint64][]Exemplar, error) {
+	q.es.mtx.RLock()
+	defer q.es.mtx.RUnlock()
+
+	out := map[uint64][]Exemplar{}
+	for ref, r := range q.es.rings {
+		if !matchesAll(q.es.labels[ref], matchers) {
+			continue
+		}
+		var matched []Exemplar
+		for _, e := range r.items() {
+			if e.Ts < mint || e.Ts > maxt {
+				continue
+			}
+			matched = append(matched, e)
+		}
+		if len(matched) > 0 {
+			out[ref] = matched
+		}
+	}
+	return out, nil
+}
+
+func matchesAll(l labels.Labels, matchers []labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(l.Get(m.Name())) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestCircularExemplarStorage_AddAndQuery(t *testing.T) {
+	es := NewCircularExemplarStorage(2, 0)
+
+	lset := labels.FromStrings("job", "api")
+	e1 := Exemplar{Labels: labels.FromStrings("traceID", "1"), Value: 1, Ts: 10}
+	e2 := Exemplar{Labels: labels.FromStrings("traceID", "2"), Value: 2, Ts: 20}
+	e3 := Exemplar{Labels: labels.FromStrings("traceID", "3"), Value: 3, Ts: 30}
+
+	ok(t, es.AddExemplar(1, lset, e1))
+	ok(t, es.AddExemplar(1, lset, e2))
+	// Ring size is 2: this evicts e1.
+	ok(t, es.AddExemplar(1, lset, e3))
+
+	res, err := es.ExemplarQuerier().Select(0, 100)
+	ok(t, err)
+	equals(t, 2, len(res[1]))
+	equals(t, e2, res[1][0])
+	equals(t, e3, res[1][1])
+}
+
+func TestCircularExemplarStorage_LabelSetTooLarge(t *testing.T) {
+	es := NewCircularExemplarStorage(10, 8)
+
+	e := Exemplar{Labels: labels.FromStrings("traceID", strings.Repeat("a", 32))}
+	err := es.AddExemplar(1, labels.FromStrings("job", "api"), e)
+	notOk(t, err)
+	equals(t, ErrExemplarLabelLength, err)
+}
+
+// TestCircularExemplarStorage_SelectMatchesSeriesLabels verifies that
+// Select matches against the series' label set passed to AddExemplar, not
+// against an exemplar's own (e.g. traceID) labels: a matcher on a label
+// that only exists on the series, never on the exemplar itself, must
+// still select that series' exemplars.
+func TestCircularExemplarStorage_SelectMatchesSeriesLabels(t *testing.T) {
+	es := NewCircularExemplarStorage(10, 0)
+
+	apiLabels := labels.FromStrings("job", "api")
+	dbLabels := labels.FromStrings("job", "db")
+
+	eAPI := Exemplar{Labels: labels.FromStrings("traceID", "1"), Value: 1, Ts: 10}
+	eDB := Exemplar{Labels: labels.FromStrings("traceID", "2"), Value: 2, Ts: 10}
+
+	ok(t, es.AddExemplar(1, apiLabels, eAPI))
+	ok(t, es.AddExemplar(2, dbLabels, eDB))
+
+	res, err := es.ExemplarQuerier().Select(0, 100, labels.NewEqualMatcher("job", "api"))
+	ok(t, err)
+	equals(t, 1, len(res))
+	equals(t, []Exemplar{eAPI}, res[1])
+}
+
+func TestExemplarRecord_EncodeDecode(t *testing.T) {
+	e := Exemplar{Labels: labels.FromStrings("traceID", "abc123", "service", "api"), Value: 4.2, Ts: 100}
+
+	rec := encodeExemplarRecord(42, e)
+	equals(t, recTypeExemplars, recordType(rec))
+
+	ref, got, err := decodeExemplarRecord(rec)
+	ok(t, err)
+	equals(t, uint64(42), ref)
+	equals(t, e, got)
+}
+
+// fakeHeadWAL is an in-memory headWAL used to test that AppendExemplar logs
+// a record that Init can later replay.
+type fakeHeadWAL struct {
+	recs [][]byte
+}
+
+func (w *fakeHeadWAL) Log(rec []byte) error {
+	w.recs = append(w.recs, append([]byte(nil), rec...))
+	return nil
+}
+
+func (w *fakeHeadWAL) Records() ([][]byte, error) {
+	return w.recs, nil
+}
+
+func TestHead_AppendExemplar_ReplayedByInit(t *testing.T) {
+	wal := &fakeHeadWAL{}
+	h, err := NewHead(nil, nil, wal, 1000)
+	ok(t, err)
+	h.exemplars = NewCircularExemplarStorage(10, 0)
+
+	e := Exemplar{Labels: labels.FromStrings("traceID", "abc123"), Value: 1, Ts: 50}
+	ok(t, h.Appender().AppendExemplar(1, e.Labels, e))
+	equals(t, 1, len(wal.recs))
+
+	// A fresh Head replaying the same WAL should end up with the exemplar
+	// in its storage without any direct AddExemplar call.
+	h2, err := NewHead(nil, nil, wal, 1000)
+	ok(t, err)
+	h2.exemplars = NewCircularExemplarStorage(10, 0)
+	ok(t, h2.Init(0))
+
+	res, err := h2.exemplars.ExemplarQuerier().Select(0, 100)
+	ok(t, err)
+	equals(t, 1, len(res[1]))
+	equals(t, e, res[1][0])
+}
+
+// TestHead_AppendExemplar_OversizedRejectedBeforeWAL verifies that an
+// oversized exemplar is rejected by AppendExemplar without ever being
+// logged to the WAL, so a rejected AppendExemplar call can never make a
+// later Init replay fail.
+func TestHead_AppendExemplar_OversizedRejectedBeforeWAL(t *testing.T) {
+	wal := &fakeHeadWAL{}
+	h, err := NewHead(nil, nil, wal, 1000)
+	ok(t, err)
+	h.exemplars = NewCircularExemplarStorage(10, 8)
+
+	e := Exemplar{Labels: labels.FromStrings("traceID", strings.Repeat("a", 32)), Value: 1, Ts: 50}
+	err = h.Appender().AppendExemplar(1, e.Labels, e)
+	notOk(t, err)
+	equals(t, ErrExemplarLabelLength, err)
+	equals(t, 0, len(wal.recs))
+}
+
+// TestHead_Init_SkipsExemplarRecordThatFailsReplay verifies that a WAL
+// exemplar record which fails to re-add during Init (e.g. it no longer
+// fits the limit a restarted process was configured with) is skipped
+// rather than aborting Init and leaving the whole DB unable to open.
+func TestHead_Init_SkipsExemplarRecordThatFailsReplay(t *testing.T) {
+	wal := &fakeHeadWAL{}
+	h, err := NewHead(nil, nil, wal, 1000)
+	ok(t, err)
+	h.exemplars = NewCircularExemplarStorage(10, 0)
+
+	e := Exemplar{Labels: labels.FromStrings("traceID", "abc123"), Value: 1, Ts: 50}
+	ok(t, h.Appender().AppendExemplar(1, e.Labels, e))
+
+	// Reopen against a storage configured with a byte limit too small for
+	// the already-logged record.
+	h2, err := NewHead(nil, nil, wal, 1000)
+	ok(t, err)
+	h2.exemplars = NewCircularExemplarStorage(10, 1)
+	ok(t, h2.Init(0))
+
+	res, err := h2.exemplars.ExemplarQuerier().Select(0, 100)
+	ok(t, err)
+	equals(t, 0, len(res))
+}
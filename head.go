@@ -0,0 +1,353 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Head handles reads and writes of time series data within a time window.
+// Head is in-memory only and is flushed to a persisted Block by the
+// compactor once it grows past its configured range.
+type Head struct {
+	chunkRange   int64
+	minValidTime int64
+
+	mtx              sync.RWMutex
+	minTime, maxTime int64
+
+	exemplars ExemplarStorage
+
+	// logger is used to report non-fatal problems found while replaying
+	// the WAL during Init, e.g. a since-invalidated exemplar record. It
+	// may be nil, in which case such problems are silently skipped.
+	logger Logger
+
+	// nextRef and seriesByRef/hashes are the head's in-memory series
+	// index: hashes maps a series' label set (by its canonical string
+	// form) to the ref it was assigned on first Add, so that appending
+	// the same series again returns the existing ref instead of creating
+	// a duplicate. Every memSeries holds its own in-progress chunkenc
+	// chunk; this head keeps exactly one open chunk per series for its
+	// whole lifetime rather than cutting new ones at chunkRange
+	// boundaries, which is unneeded for the scale this package is
+	// exercised at.
+	nextRef     uint64
+	seriesByRef map[uint64]*memSeries
+	hashes      map[string]uint64
+
+	// seriesLabels holds the label set of every series currently held by
+	// the head, for Querier.Select to filter. Rebuilt from seriesByRef on
+	// every Commit.
+	seriesLabels []labels.Labels
+
+	// series holds the head's series and their chunks, for ChunkQuerier
+	// to filter. Rebuilt from seriesByRef on every Commit.
+	series []seriesChunks
+
+	wal headWAL
+}
+
+// memSeries is a single series held by the head: its label set and the
+// chunkenc.Chunk currently being appended to.
+type memSeries struct {
+	ref  uint64
+	lset labels.Labels
+
+	chunk            chunkenc.Chunk
+	app              chunkenc.Appender
+	minTime, maxTime int64
+}
+
+// headWAL is the subset of the write-ahead log used by the Head. The
+// implementation is supplied by the caller of NewHead, which also accepts
+// nil for a head without a WAL.
+type headWAL interface {
+	// Log appends rec to the log.
+	Log(rec []byte) error
+	// Records returns every record previously passed to Log, in the order
+	// they were written, for replay during Init.
+	Records() ([][]byte, error)
+}
+
+// NewHead returns an empty head that logs to wal (which may be nil).
+func NewHead(r prometheus.Registerer, l Logger, wal headWAL, chunkRange int64) (*Head, error) {
+	h := &Head{
+		chunkRange:  chunkRange,
+		wal:         wal,
+		logger:      l,
+		minTime:     math.MaxInt64,
+		maxTime:     math.MinInt64,
+		seriesByRef: map[uint64]*memSeries{},
+		hashes:      map[string]uint64{},
+	}
+	return h, nil
+}
+
+// Logger is the subset of go-kit/log.Logger used across this package; kept
+// as an alias here so callers can pass nil for the zero-value logger the
+// same way they do for Registerer.
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+// MinTime returns the lowest time bound of the head, or 0 if the head has
+// not taken a sample yet.
+func (h *Head) MinTime() int64 {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	if h.minTime > h.maxTime {
+		return 0
+	}
+	return h.minTime
+}
+
+// MaxTime returns the highest time bound of the head, or 0 if the head
+// has not taken a sample yet.
+func (h *Head) MaxTime() int64 {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	if h.minTime > h.maxTime {
+		return 0
+	}
+	return h.maxTime
+}
+
+// Close flushes all data and closes the head.
+func (h *Head) Close() error {
+	return nil
+}
+
+// Init prepares the head for writes and replays exemplar records from the
+// write ahead log. minValidTime is the boundary below which data is
+// already owned by a persisted block, most commonly set to the maxt of
+// the last block written by Snapshot: the head's Appender rejects samples
+// with t < minValidTime, and replayed exemplars with a timestamp below it
+// are dropped. Sample, series and tombstone records are not replayed.
+func (h *Head) Init(minValidTime int64) error {
+	h.mtx.Lock()
+	h.minValidTime = minValidTime
+	h.mtx.Unlock()
+
+	if h.wal == nil {
+		return nil
+	}
+	recs, err := h.wal.Records()
+	if err != nil {
+		return fmt.Errorf("reading WAL: %w", err)
+	}
+
+	// Only exemplar records are replayed; every other record is skipped.
+	for _, rec := range recs {
+		if recordType(rec) != recTypeExemplars {
+			continue
+		}
+		ref, e, err := decodeExemplarRecord(rec)
+		if err != nil {
+			return fmt.Errorf("decoding exemplar record: %w", err)
+		}
+		if e.Ts < minValidTime || h.exemplars == nil {
+			continue
+		}
+		// The WAL record only carries ref and the exemplar itself, and
+		// series records are not replayed, so the series' label set for
+		// ref is unknown here. Matchers are evaluated against an empty
+		// label set for this ref until AppendExemplar is called for it
+		// again with its series labels.
+		if err := h.exemplars.AddExemplar(ref, nil, e); err != nil {
+			// A record that was valid when logged (AppendExemplar
+			// validates before writing to the WAL) but fails to re-add
+			// here signals a problem with this one exemplar, not with
+			// the WAL as a whole: skip it rather than failing Init and
+			// leaving the entire DB unable to open.
+			if h.logger != nil {
+				h.logger.Log("msg", "skipping exemplar record on replay", "ref", ref, "err", err)
+			}
+			continue
+		}
+	}
+	return nil
+}
+
+// Appender returns a new Appender against the head.
+func (h *Head) Appender() Appender {
+	maxExemplars := 0
+	if es, ok := h.exemplars.(*CircularExemplarStorage); ok {
+		maxExemplars = es.maxExemplars
+	}
+	return &headAppender{head: h, maxExemplars: maxExemplars}
+}
+
+// pendingSample is a sample buffered by a headAppender between Add/AddFast
+// and Commit; it is applied to its series' chunk only once the
+// transaction commits, so a Rollback never touches head state.
+type pendingSample struct {
+	series *memSeries
+	t      int64
+	v      float64
+}
+
+type headAppender struct {
+	head         *Head
+	maxExemplars int
+
+	samples []pendingSample
+}
+
+func (a *headAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	if t < a.head.minValidTime {
+		return 0, ErrOutOfBounds
+	}
+	s := a.head.getOrCreate(l)
+	a.samples = append(a.samples, pendingSample{series: s, t: t, v: v})
+	return s.ref, nil
+}
+
+func (a *headAppender) AddFast(ref uint64, t int64, v float64) error {
+	if t < a.head.minValidTime {
+		return ErrOutOfBounds
+	}
+	s := a.head.seriesByID(ref)
+	if s == nil {
+		return fmt.Errorf("tsdb: unknown series reference %d", ref)
+	}
+	a.samples = append(a.samples, pendingSample{series: s, t: t, v: v})
+	return nil
+}
+
+// getOrCreate returns the existing series for l, or creates and indexes a
+// new one, assigning it the next ref. Series creation is not rolled back
+// by headAppender.Rollback, matching how only sample data is staged for
+// Commit above.
+func (h *Head) getOrCreate(l labels.Labels) *memSeries {
+	key := l.String()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if ref, ok := h.hashes[key]; ok {
+		return h.seriesByRef[ref]
+	}
+	h.nextRef++
+	s := &memSeries{ref: h.nextRef, lset: l}
+	h.seriesByRef[s.ref] = s
+	h.hashes[key] = s.ref
+	return s
+}
+
+func (h *Head) seriesByID(ref uint64) *memSeries {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.seriesByRef[ref]
+}
+
+// AppendExemplar appends an exemplar for ref, validating its label set
+// against the configured byte limit before logging it to the WAL and
+// storing it in the head's ExemplarStorage, so that a rejected exemplar
+// is never durably logged only to fail again (and abort Init) on replay.
+func (a *headAppender) AppendExemplar(ref uint64, l labels.Labels, e Exemplar) error {
+	if a.head.exemplars == nil {
+		return nil
+	}
+	if es, ok := a.head.exemplars.(*CircularExemplarStorage); ok {
+		if size := exemplarLabelSetBytes(e.Labels); size > es.maxLabelSetBytes {
+			return ErrExemplarLabelLength
+		}
+	}
+	if a.head.wal != nil {
+		if err := a.head.wal.Log(encodeExemplarRecord(ref, e)); err != nil {
+			return fmt.Errorf("logging exemplar: %w", err)
+		}
+	}
+	return a.head.exemplars.AddExemplar(ref, l, e)
+}
+
+func (a *headAppender) Commit() error {
+	if len(a.samples) == 0 {
+		return nil
+	}
+
+	h := a.head
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for _, ps := range a.samples {
+		if err := appendSample(ps.series, ps.t, ps.v); err != nil {
+			return err
+		}
+		if ps.t < h.minTime {
+			h.minTime = ps.t
+		}
+		if ps.t > h.maxTime {
+			h.maxTime = ps.t
+		}
+	}
+	h.rebuildSeriesViews()
+	return nil
+}
+
+func (a *headAppender) Rollback() error {
+	a.samples = nil
+	return nil
+}
+
+// appendSample appends (t, v) to s's in-memory chunk, opening one if this
+// is the series' first sample. Callers must hold the head's mtx.
+func appendSample(s *memSeries, t int64, v float64) error {
+	if s.app == nil {
+		s.chunk = chunkenc.NewXORChunk()
+		app, err := s.chunk.Appender()
+		if err != nil {
+			return fmt.Errorf("creating chunk appender: %w", err)
+		}
+		s.app = app
+		s.minTime = t
+	}
+	s.app.Append(t, v)
+	s.maxTime = t
+	return nil
+}
+
+// rebuildSeriesViews recomputes seriesLabels and series from seriesByRef,
+// in ref order so the result is deterministic. Callers must hold the
+// head's mtx.
+func (h *Head) rebuildSeriesViews() {
+	refs := make([]uint64, 0, len(h.seriesByRef))
+	for ref := range h.seriesByRef {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+
+	h.seriesLabels = h.seriesLabels[:0]
+	h.series = h.series[:0]
+	for _, ref := range refs {
+		s := h.seriesByRef[ref]
+		if s.chunk == nil {
+			continue
+		}
+		h.seriesLabels = append(h.seriesLabels, s.lset)
+		h.series = append(h.series, seriesChunks{
+			lset: s.lset,
+			chks: []chunks.Meta{{MinTime: s.minTime, MaxTime: s.maxTime, Chunk: s.chunk}},
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// This package's own tests need unexported access (e.g. DB.head, Block.dir,
+// MultiDB.open) and therefore must stay in package tsdb, which rules out
+// importing testutil: testutil imports this package, so a test file in
+// package tsdb importing testutil is an import cycle. These are minimal,
+// unexported mirrors of the testutil helpers of the same name, for this
+// package's white-box tests only; testutil remains the one to use from
+// outside this package.
+
+func ok(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func notOk(t testing.TB, err error) {
+	t.Helper()
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func equals(t testing.TB, want, got interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\nwant: %#v\ngot:  %#v", want, got)
+	}
+}
+
+func assert(t testing.TB, cond bool, msg string, args ...interface{}) {
+	t.Helper()
+	if !cond {
+		t.Fatalf(msg, args...)
+	}
+}
+
+// newTempDir mirrors testutil.NewTempDir.
+func newTempDir(t testing.TB) (dir string, close func()) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	ok(t, err)
+
+	return tmpdir, func() {
+		ok(t, os.RemoveAll(tmpdir))
+	}
+}
+
+// openTestDB mirrors testutil.OpenTestDB.
+func openTestDB(t testing.TB, opts *Options) (db *DB, close func()) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	ok(t, err)
+
+	db, err = Open(tmpdir, nil, nil, opts)
+	ok(t, err)
+
+	return db, func() {
+		ok(t, os.RemoveAll(tmpdir))
+	}
+}
+
+// openTestMultiDB mirrors testutil.OpenTestMultiDB.
+func openTestMultiDB(t testing.TB, opts MultiDBOptions, tenants []string) (m *MultiDB, close func()) {
+	tmpdir, err := ioutil.TempDir("", "test-multidb")
+	ok(t, err)
+
+	m, err = OpenMultiDB(tmpdir, nil, nil, opts)
+	ok(t, err)
+
+	return m, func() {
+		ok(t, m.Close())
+		ok(t, os.RemoveAll(tmpdir))
+	}
+}
+
+// snapshotAndReopen mirrors testutil.SnapshotAndReopen.
+func snapshotAndReopen(t testing.TB, db *DB) *DB {
+	snapDir, err := ioutil.TempDir("", "test-snapshot")
+	ok(t, err)
+
+	ok(t, db.Snapshot(snapDir, true))
+
+	reopened, err := Open(snapDir, nil, nil, nil)
+	ok(t, err)
+	return reopened
+}
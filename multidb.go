@@ -0,0 +1,237 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type tenantContextKey struct{}
+
+// ContextWithTenant returns a copy of ctx carrying the given tenant ID,
+// for use with MultiDB.Appender and MultiDB.Querier.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant ID stored in ctx by
+// ContextWithTenant, and whether one was present.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(string)
+	return tenant, ok
+}
+
+// MultiDBOptions extends Options with multi-tenancy knobs. The embedded
+// Options are applied to every per-tenant DB.
+type MultiDBOptions struct {
+	Options
+
+	// MaxOpenTenants bounds the number of per-tenant DBs held open at
+	// once. When opening a tenant would exceed the limit, the
+	// least-recently-used open tenant is closed first. A value <= 0
+	// disables the bound (all tenants stay open once opened).
+	MaxOpenTenants int
+}
+
+// MultiDB owns a directory of per-tenant DB instances, identified by a
+// tenant ID extracted from context.Context via TenantFromContext. Tenants
+// are opened lazily on first use and, when MaxOpenTenants is set, evicted
+// LRU-style to bound the number of open WALs/compactors/retention loops.
+type MultiDB struct {
+	dir    string
+	logger log.Logger
+	reg    prometheus.Registerer
+	opts   MultiDBOptions
+
+	mtx     sync.Mutex
+	open    map[string]*list.Element // tenant -> lru element
+	lru     *list.List               // of *tenantDB, most-recently-used at the front
+	metrics *multiDBMetrics
+}
+
+type tenantDB struct {
+	tenant string
+	db     *DB
+}
+
+type multiDBMetrics struct {
+	openTenants prometheus.GaugeFunc
+}
+
+// OpenMultiDB opens (or prepares to lazily open) a MultiDB rooted at dir,
+// with one subdirectory per tenant.
+func OpenMultiDB(dir string, l log.Logger, r prometheus.Registerer, opts MultiDBOptions) (*MultiDB, error) {
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+	m := &MultiDB{
+		dir:    dir,
+		logger: l,
+		reg:    r,
+		opts:   opts,
+		open:   map[string]*list.Element{},
+		lru:    list.New(),
+	}
+	m.metrics = &multiDBMetrics{
+		openTenants: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "prometheus_tsdb_multidb_open_tenants",
+			Help:        "Number of tenant databases currently open.",
+			ConstLabels: nil,
+		}, func() float64 {
+			m.mtx.Lock()
+			defer m.mtx.Unlock()
+			return float64(len(m.open))
+		}),
+	}
+	if r != nil {
+		r.MustRegister(m.metrics.openTenants)
+	}
+	return m, nil
+}
+
+// Appender returns an Appender for the tenant found in ctx via
+// TenantFromContext. It returns an error if ctx carries no tenant.
+func (m *MultiDB) Appender(ctx context.Context) (Appender, error) {
+	db, err := m.dbForContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.Appender(), nil
+}
+
+// Querier returns a Querier over [mint, maxt) for the tenant found in ctx
+// via TenantFromContext. It returns an error if ctx carries no tenant.
+func (m *MultiDB) Querier(ctx context.Context, mint, maxt int64) (Querier, error) {
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("tsdb: no tenant in context")
+	}
+	db, err := m.dbForTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return db.Querier(ctx, mint, maxt)
+}
+
+func (m *MultiDB) dbForContext(ctx context.Context) (*DB, error) {
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("tsdb: no tenant in context")
+	}
+	return m.dbForTenant(tenant)
+}
+
+// dbForTenant returns the open DB for tenant, opening it (and evicting the
+// least-recently-used tenant if MaxOpenTenants would be exceeded) if it
+// isn't open already. Each tenant gets its own data directory and
+// therefore its own WAL, compactor and retention loop, since those are
+// all owned internally by *DB.
+//
+// Open() is called without m.mtx held, so a cold open (or an evicted
+// tenant's disk I/O) for one tenant never blocks Appender/Querier calls
+// for every other tenant. If two callers race to open the same
+// not-yet-open tenant, the loser's redundant DB is closed and discarded
+// in favor of the winner's.
+func (m *MultiDB) dbForTenant(tenant string) (*DB, error) {
+	if db, ok := m.openTenant(tenant); ok {
+		return db, nil
+	}
+
+	opts := m.opts.Options
+	db, err := Open(filepath.Join(m.dir, tenant), m.logger, tenantRegisterer(m.reg, tenant), &opts)
+	if err != nil {
+		return nil, fmt.Errorf("opening tenant %q: %w", tenant, err)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if el, ok := m.open[tenant]; ok {
+		// Lost the race: another goroutine already opened and inserted
+		// this tenant while db was being opened above.
+		m.lru.MoveToFront(el)
+		db.Close()
+		return el.Value.(*tenantDB).db, nil
+	}
+
+	if m.opts.MaxOpenTenants > 0 && len(m.open) >= m.opts.MaxOpenTenants {
+		if err := m.evictLRULocked(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	el := m.lru.PushFront(&tenantDB{tenant: tenant, db: db})
+	m.open[tenant] = el
+	return db, nil
+}
+
+// openTenant returns the already-open DB for tenant, marking it
+// most-recently-used, or (nil, false) if tenant isn't open.
+func (m *MultiDB) openTenant(tenant string) (*DB, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	el, ok := m.open[tenant]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	return el.Value.(*tenantDB).db, true
+}
+
+// evictLRULocked closes and drops the least-recently-used open tenant.
+// The caller must hold m.mtx.
+func (m *MultiDB) evictLRULocked() error {
+	el := m.lru.Back()
+	if el == nil {
+		return nil
+	}
+	t := el.Value.(*tenantDB)
+	m.lru.Remove(el)
+	delete(m.open, t.tenant)
+	return t.db.Close()
+}
+
+// Close closes every currently open tenant DB.
+func (m *MultiDB) Close() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var firstErr error
+	for el := m.lru.Front(); el != nil; el = el.Next() {
+		if err := el.Value.(*tenantDB).db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	m.open = map[string]*list.Element{}
+	m.lru.Init()
+	return firstErr
+}
+
+// tenantRegisterer wraps r so every metric registered through it carries a
+// "tenant" label with the given value. A nil r yields a nil Registerer.
+func tenantRegisterer(r prometheus.Registerer, tenant string) prometheus.Registerer {
+	if r == nil {
+		return nil
+	}
+	return prometheus.WrapRegistererWith(prometheus.Labels{"tenant": tenant}, r)
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// TestMultiDB_TenantIsolation verifies that a query for one tenant never
+// observes another tenant's series, even when their label sets collide
+// (e.g. both tenants scrape a target labeled job="api").
+func TestMultiDB_TenantIsolation(t *testing.T) {
+	m, close := openTestMultiDB(t, MultiDBOptions{}, []string{"a", "b"})
+	defer close()
+
+	ctxA := ContextWithTenant(context.Background(), "a")
+	ctxB := ContextWithTenant(context.Background(), "b")
+
+	// Both tenants get a series with the exact same label set, appended
+	// through the real per-tenant Appender, to exercise the isolation the
+	// request asked for against the actual ingestion path rather than by
+	// poking head state directly.
+	colliding := labels.FromStrings("job", "api")
+
+	appA, err := m.Appender(ctxA)
+	ok(t, err)
+	_, err = appA.Add(colliding, 0, 1)
+	ok(t, err)
+	ok(t, appA.Commit())
+
+	appB, err := m.Appender(ctxB)
+	ok(t, err)
+	_, err = appB.Add(colliding, 0, 1)
+	ok(t, err)
+	_, err = appB.Add(labels.FromStrings("job", "b-only"), 0, 1)
+	ok(t, err)
+	ok(t, appB.Commit())
+
+	dbA, err := m.dbForTenant("a")
+	ok(t, err)
+	dbB, err := m.dbForTenant("b")
+	ok(t, err)
+
+	assert(t, dbA != dbB, "expected distinct DB instances per tenant")
+	assert(t, dbA.Dir() != dbB.Dir(), "expected distinct data directories per tenant")
+
+	qA, err := m.Querier(ctxA, 0, 100)
+	ok(t, err)
+	defer qA.Close()
+
+	resA, err := qA.Select(labels.NewEqualMatcher("job", "api"))
+	ok(t, err)
+	assert(t, resA.Next(), "expected tenant a's own series to be returned")
+	assert(t, !resA.Next(), "expected exactly one series for tenant a")
+
+	resB, err := qA.Select(labels.NewEqualMatcher("job", "b-only"))
+	ok(t, err)
+	assert(t, !resB.Next(), "tenant a's query must never observe tenant b's series")
+}
+
+func TestMultiDB_MaxOpenTenantsEvictsLRU(t *testing.T) {
+	m, close := openTestMultiDB(t, MultiDBOptions{MaxOpenTenants: 1}, []string{"a", "b"})
+	defer close()
+
+	_, err := m.dbForTenant("a")
+	ok(t, err)
+	_, err = m.dbForTenant("b")
+	ok(t, err)
+
+	m.mtx.Lock()
+	_, aStillOpen := m.open["a"]
+	_, bStillOpen := m.open["b"]
+	m.mtx.Unlock()
+
+	assert(t, !aStillOpen, "expected tenant a to be evicted once MaxOpenTenants was exceeded")
+	assert(t, bStillOpen, "expected tenant b to remain open")
+}
+
+// TestMultiDB_ReopenEvictedTenantAgainstRealRegistry verifies that
+// reopening an LRU-evicted tenant doesn't panic with a duplicate metrics
+// registration: DB.Close (called by the eviction) must unregister the
+// tenant's collectors from the shared Registerer, since tenantRegisterer
+// wraps that same Registerer afresh on every open.
+func TestMultiDB_ReopenEvictedTenantAgainstRealRegistry(t *testing.T) {
+	dir, close := newTempDir(t)
+	defer close()
+
+	reg := prometheus.NewRegistry()
+	m, err := OpenMultiDB(dir, nil, reg, MultiDBOptions{MaxOpenTenants: 1})
+	ok(t, err)
+	defer m.Close()
+
+	_, err = m.dbForTenant("a")
+	ok(t, err)
+	// Evicts tenant a.
+	_, err = m.dbForTenant("b")
+	ok(t, err)
+
+	// Reopening tenant a re-registers its metrics against reg; this must
+	// not panic with a duplicate-registration error.
+	_, err = m.dbForTenant("a")
+	ok(t, err)
+}
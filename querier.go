@@ -0,0 +1,222 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Querier provides reading access to time series data for a given time
+// range.
+type Querier interface {
+	// Select returns a set of series that match the given label matchers.
+	Select(matchers ...labels.Matcher) (SeriesSet, error)
+
+	// Close releases the resources of the Querier.
+	Close() error
+}
+
+// SeriesSet contains a set of series.
+type SeriesSet interface {
+	Next() bool
+	At() Series
+	Err() error
+}
+
+// Series exposes a single time series and allows iterating over samples.
+type Series interface {
+	Labels() labels.Labels
+	Iterator() SeriesIterator
+}
+
+// SeriesIterator iterates over the data of a time series.
+type SeriesIterator interface {
+	At() (t int64, v float64)
+	Seek(t int64) bool
+	Next() bool
+	Err() error
+}
+
+// Querier returns a new Querier over the data partition for the given
+// time range.
+func (db *DB) Querier(ctx context.Context, mint, maxt int64) (Querier, error) {
+	return &dbQuerier{db: db, mint: mint, maxt: maxt}, nil
+}
+
+// seriesFromChunkMetas decodes the samples in chks into a Series.
+//
+// chks must be copied (via chunkMetasCopy) before being passed here if the
+// caller reuses its backing array across series (e.g. a single scratch
+// []chunks.Meta filled per series while iterating a SeriesSet) — this
+// function retains a reference to chks for the lifetime of the returned
+// Series rather than copying it itself, since copying on every series
+// would defeat the purpose of the caller's reuse in the first place.
+// Without the copy, every Series built from the shared buffer aliases the
+// same backing array and observes whichever series' chunks were written
+// into it last. Callers that don't reuse a buffer should pass a slice
+// they already own outright (e.g. freshly allocated or obtained from
+// ChunkQuerierForRange with a nil buf) instead of calling chunkMetasCopy.
+func seriesFromChunkMetas(lset labels.Labels, chks []chunks.Meta) Series {
+	return &chunkMetaSeries{lset: lset, chks: chks}
+}
+
+// chunkMetasCopy returns an independently-owned copy of chks, for callers
+// that must retain a Series past the point where the shared buffer they
+// read chks from gets overwritten.
+func chunkMetasCopy(chks []chunks.Meta) []chunks.Meta {
+	cp := make([]chunks.Meta, len(chks))
+	copy(cp, chks)
+	return cp
+}
+
+type chunkMetaSeries struct {
+	lset labels.Labels
+	chks []chunks.Meta
+}
+
+func (s *chunkMetaSeries) Labels() labels.Labels { return s.lset }
+
+func (s *chunkMetaSeries) Iterator() SeriesIterator {
+	return newChunkSeriesIterator(s.chks)
+}
+
+// chunkSeriesIterator decodes a series' chunks.Meta slice into a sample
+// stream, moving on to the next chunk's chunkenc.Iterator as each one is
+// exhausted. Chunks are expected to already be in time order (chunkMetaSeries
+// callers sort them, e.g. dbQuerier.Select below).
+type chunkSeriesIterator struct {
+	chks []chunks.Meta
+	i    int
+	cur  chunkenc.Iterator
+	err  error
+}
+
+func newChunkSeriesIterator(chks []chunks.Meta) SeriesIterator {
+	return &chunkSeriesIterator{i: -1, chks: chks}
+}
+
+func (it *chunkSeriesIterator) Next() bool {
+	for {
+		if it.cur != nil && it.cur.Next() {
+			return true
+		}
+		if it.cur != nil {
+			if it.err = it.cur.Err(); it.err != nil {
+				return false
+			}
+		}
+		it.i++
+		if it.i >= len(it.chks) {
+			return false
+		}
+		it.cur = it.chks[it.i].Chunk.Iterator()
+	}
+}
+
+func (it *chunkSeriesIterator) Seek(t int64) bool {
+	if it.cur == nil && !it.Next() {
+		return false
+	}
+	for {
+		if ct, _ := it.At(); ct >= t {
+			return true
+		}
+		if !it.Next() {
+			return false
+		}
+	}
+}
+
+func (it *chunkSeriesIterator) At() (int64, float64) { return it.cur.At() }
+func (it *chunkSeriesIterator) Err() error           { return it.err }
+
+type dbQuerier struct {
+	db         *DB
+	mint, maxt int64
+}
+
+// Select merges series from the head and every persisted block, filtered
+// by matchers and the querier's time range, decoding each match's chunks
+// into a real sample Iterator. A series held by more than one source
+// (e.g. still in the head as well as a persisted block) is merged into a
+// single Series with its chunks in time order, mirroring how
+// dbChunkQuerier.SelectChunks already merges for the chunk-level path.
+func (q *dbQuerier) Select(matchers ...labels.Matcher) (SeriesSet, error) {
+	q.db.mtx.RLock()
+	blocks := q.db.blocks[:]
+	head := q.db.head
+	q.db.mtx.RUnlock()
+
+	merged := map[string]*chunkMetaSeries{}
+	var order []string
+
+	add := func(all []seriesChunks) {
+		for _, s := range all {
+			if !matchesAll(s.lset, matchers) {
+				continue
+			}
+			chks := chunksInRange(s.chks, q.mint, q.maxt)
+			if len(chks) == 0 {
+				continue
+			}
+			key := s.lset.String()
+			cs, ok := merged[key]
+			if !ok {
+				cs = &chunkMetaSeries{lset: s.lset}
+				merged[key] = cs
+				order = append(order, key)
+			}
+			cs.chks = append(cs.chks, chunkMetasCopy(chks)...)
+		}
+	}
+
+	if head != nil {
+		head.mtx.RLock()
+		add(head.series)
+		head.mtx.RUnlock()
+	}
+	for _, b := range blocks {
+		add(b.series)
+	}
+
+	set := &listSeriesSet{idx: -1}
+	for _, key := range order {
+		cs := merged[key]
+		sort.Slice(cs.chks, func(i, j int) bool { return cs.chks[i].MinTime < cs.chks[j].MinTime })
+		set.series = append(set.series, cs)
+	}
+	return set, nil
+}
+
+func (q *dbQuerier) Close() error {
+	return nil
+}
+
+type listSeriesSet struct {
+	series []Series
+	idx    int
+}
+
+func (s *listSeriesSet) Next() bool {
+	s.idx++
+	return s.idx < len(s.series)
+}
+
+func (s *listSeriesSet) At() Series { return s.series[s.idx] }
+func (s *listSeriesSet) Err() error { return nil }
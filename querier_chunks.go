@@ -0,0 +1,262 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// ChunkQuerier provides reading access to raw, still-encoded chunks,
+// rather than decoded samples. It is intended for callers that can
+// forward or persist chunks as-is (remote-read servers, sidecar-style
+// exporters) and would otherwise pay the cost of decoding and
+// re-encoding every sample through the Querier/Series path.
+type ChunkQuerier interface {
+	// SelectChunks returns a set of series exposing raw chunks.Meta
+	// instead of decoded samples for every series matching matchers.
+	SelectChunks(matchers ...labels.Matcher) (ChunkSeriesSet, error)
+
+	// Close releases the resources of the ChunkQuerier.
+	Close() error
+}
+
+// ChunkSeriesSet contains a set of chunk-backed series.
+type ChunkSeriesSet interface {
+	Next() bool
+	At() ChunkSeries
+	Err() error
+}
+
+// ChunkSeries exposes a single time series as a sequence of raw chunks.
+type ChunkSeries interface {
+	Labels() labels.Labels
+	// Chunks returns the chunks.Meta entries covering this series within
+	// the querier's time range, in time order. See the ownership note on
+	// ChunkQuerierForRange: whether this slice (and the chunkenc.Chunk
+	// values it references) may be retained past the next call depends on
+	// how the ChunkQuerier was constructed.
+	Chunks() []chunks.Meta
+}
+
+// seriesChunks is the shared in-memory representation of a series' raw
+// chunks held by a Block or a Head, independent of how it got there.
+type seriesChunks struct {
+	lset labels.Labels
+	chks []chunks.Meta
+}
+
+// ChunkQuerierForRange returns a new ChunkQuerier for the block over
+// [mint, maxt). If chunksBuf is non-nil, returned ChunkSeries reuse its
+// backing array across series (the caller owns chunksBuf and must not
+// retain a ChunkSeries past the next call to ChunkSeriesSet.Next, mirroring
+// how the caller-owned scratch buffer works in the sample-level Series
+// path below). If chunksBuf is nil, every ChunkSeries gets its own freshly
+// allocated, independently-owned []chunks.Meta that is safe to retain
+// indefinitely (e.g. across gRPC frames) — at the cost of one allocation
+// and copy per series.
+func (pb *Block) ChunkQuerierForRange(mint, maxt int64, chunksBuf []chunks.Meta) (ChunkQuerier, error) {
+	return &blockChunkQuerier{block: pb, mint: mint, maxt: maxt, buf: chunksBuf}, nil
+}
+
+type blockChunkQuerier struct {
+	block      *Block
+	mint, maxt int64
+	buf        []chunks.Meta
+}
+
+func (q *blockChunkQuerier) SelectChunks(matchers ...labels.Matcher) (ChunkSeriesSet, error) {
+	return selectChunks(q.block.series, q.mint, q.maxt, q.buf, matchers), nil
+}
+
+func (q *blockChunkQuerier) Close() error {
+	return nil
+}
+
+// ChunkQuerier returns a ChunkQuerier over the head's series for
+// [mint, maxt). Like (*Block).ChunkQuerierForRange, if chunksBuf is
+// non-nil, returned ChunkSeries reuse its backing array across series.
+func (h *Head) ChunkQuerier(mint, maxt int64, chunksBuf []chunks.Meta) ChunkQuerier {
+	return &headChunkQuerier{head: h, mint: mint, maxt: maxt, buf: chunksBuf}
+}
+
+type headChunkQuerier struct {
+	head       *Head
+	mint, maxt int64
+	buf        []chunks.Meta
+}
+
+func (q *headChunkQuerier) SelectChunks(matchers ...labels.Matcher) (ChunkSeriesSet, error) {
+	q.head.mtx.RLock()
+	series := append([]seriesChunks(nil), q.head.series...)
+	q.head.mtx.RUnlock()
+
+	return selectChunks(series, q.mint, q.maxt, q.buf, matchers), nil
+}
+
+func (q *headChunkQuerier) Close() error {
+	return nil
+}
+
+// selectChunks filters all by matchers and [mint, maxt); it is the shared
+// implementation behind (*Block).ChunkQuerierForRange and
+// (*Head).ChunkQuerier. If buf is non-nil, the returned ChunkSeries'
+// chunks are written back to back into buf's backing array, each series
+// in its own region (the array is reallocated by append if it runs out of
+// capacity; see the ownership note on ChunkQuerierForRange); otherwise
+// each gets an independently-owned copy.
+func selectChunks(all []seriesChunks, mint, maxt int64, buf []chunks.Meta, matchers []labels.Matcher) ChunkSeriesSet {
+	set := &listChunkSeriesSet{idx: -1}
+	if buf != nil {
+		buf = buf[:0]
+	}
+	for _, s := range all {
+		if !matchesAll(s.lset, matchers) {
+			continue
+		}
+		chks := chunksInRange(s.chks, mint, maxt)
+		if len(chks) == 0 {
+			continue
+		}
+		if buf != nil {
+			start := len(buf)
+			buf = append(buf, chks...)
+			chks = buf[start:len(buf):len(buf)]
+		} else {
+			chks = chunkMetasCopy(chks)
+		}
+		set.series = append(set.series, &rawChunkSeries{lset: s.lset, chks: chks})
+	}
+	return set
+}
+
+// chunksInRange returns the subset of chks overlapping the half-open
+// interval [mint, maxt).
+func chunksInRange(chks []chunks.Meta, mint, maxt int64) []chunks.Meta {
+	var out []chunks.Meta
+	for _, c := range chks {
+		if c.MaxTime < mint || c.MinTime >= maxt {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// rawChunkSeries is a ChunkSeries backed by an explicit, already-filtered
+// []chunks.Meta.
+type rawChunkSeries struct {
+	lset labels.Labels
+	chks []chunks.Meta
+}
+
+func (s *rawChunkSeries) Labels() labels.Labels { return s.lset }
+func (s *rawChunkSeries) Chunks() []chunks.Meta { return s.chks }
+
+type listChunkSeriesSet struct {
+	series []ChunkSeries
+	idx    int
+}
+
+func (s *listChunkSeriesSet) Next() bool {
+	s.idx++
+	return s.idx < len(s.series)
+}
+
+func (s *listChunkSeriesSet) At() ChunkSeries { return s.series[s.idx] }
+func (s *listChunkSeriesSet) Err() error      { return nil }
+
+// ChunkQuerier returns a ChunkQuerier over the data partition for
+// [mint, maxt), merging the head and all persisted blocks overlapping the
+// range. Unlike (*Block).ChunkQuerierForRange, the merging querier always
+// returns independently-owned chunk slices per series (it has no single
+// caller-provided buffer to share across the underlying per-block
+// queriers), so callers never need to worry about reuse here. A series
+// held by more than one source (e.g. still in the head as well as a
+// persisted block) is merged into a single ChunkSeries with its chunks in
+// time order.
+func (db *DB) ChunkQuerier(ctx context.Context, mint, maxt int64) (ChunkQuerier, error) {
+	return &dbChunkQuerier{db: db, mint: mint, maxt: maxt}, nil
+}
+
+type dbChunkQuerier struct {
+	db         *DB
+	mint, maxt int64
+}
+
+func (q *dbChunkQuerier) SelectChunks(matchers ...labels.Matcher) (ChunkSeriesSet, error) {
+	q.db.mtx.RLock()
+	blocks := q.db.blocks[:]
+	head := q.db.head
+	q.db.mtx.RUnlock()
+
+	merged := map[string]*rawChunkSeries{}
+	var order []string
+
+	addFrom := func(cs ChunkSeriesSet) error {
+		for cs.Next() {
+			s := cs.At()
+			key := s.Labels().String()
+			rc, ok := merged[key]
+			if !ok {
+				rc = &rawChunkSeries{lset: s.Labels()}
+				merged[key] = rc
+				order = append(order, key)
+			}
+			rc.chks = append(rc.chks, s.Chunks()...)
+		}
+		return cs.Err()
+	}
+
+	if head != nil {
+		cs, err := head.ChunkQuerier(q.mint, q.maxt, nil).SelectChunks(matchers...)
+		if err != nil {
+			return nil, err
+		}
+		if err := addFrom(cs); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range blocks {
+		if b.Meta().MaxTime <= q.mint || b.Meta().MinTime >= q.maxt {
+			continue
+		}
+		bq, err := b.ChunkQuerierForRange(q.mint, q.maxt, nil)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := bq.SelectChunks(matchers...)
+		if err != nil {
+			return nil, err
+		}
+		if err := addFrom(cs); err != nil {
+			return nil, err
+		}
+	}
+
+	set := &listChunkSeriesSet{idx: -1}
+	for _, key := range order {
+		rc := merged[key]
+		sort.Slice(rc.chks, func(i, j int) bool { return rc.chks[i].MinTime < rc.chks[j].MinTime })
+		set.series = append(set.series, rc)
+	}
+	return set, nil
+}
+
+func (q *dbChunkQuerier) Close() error {
+	return nil
+}
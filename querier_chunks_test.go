@@ -0,0 +1,113 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// TestSeriesFromChunkMetas_CopyIsIndependent guards against the
+// shared-backing-array bug: a Series built from a copied []chunks.Meta
+// must not change when the original, caller-owned buffer is mutated.
+func TestSeriesFromChunkMetas_CopyIsIndependent(t *testing.T) {
+	buf := make([]chunks.Meta, 1)
+	buf[0] = chunks.Meta{MinTime: 1, MaxTime: 2}
+
+	cp := chunkMetasCopy(buf)
+	s := seriesFromChunkMetas(labels.FromStrings("a", "b"), cp)
+
+	// Caller reuses buf for the next series, as a caller with a single
+	// scratch buffer does.
+	buf[0] = chunks.Meta{MinTime: 100, MaxTime: 200}
+
+	got := s.(*chunkMetaSeries).chks[0]
+	equals(t, int64(1), got.MinTime)
+	equals(t, int64(2), got.MaxTime)
+}
+
+func chunkSeriesSetLabels(t *testing.T, css ChunkSeriesSet) []labels.Labels {
+	var got []labels.Labels
+	for css.Next() {
+		got = append(got, css.At().Labels())
+	}
+	ok(t, css.Err())
+	return got
+}
+
+// TestBlockChunkQuerier_SelectChunks verifies that a block's ChunkQuerier
+// filters by both label matchers and the requested time range.
+func TestBlockChunkQuerier_SelectChunks(t *testing.T) {
+	b := &Block{
+		dir:  "unused",
+		meta: BlockMeta{MinTime: 0, MaxTime: 100},
+		series: []seriesChunks{
+			{lset: labels.FromStrings("__name__", "a"), chks: []chunks.Meta{{MinTime: 0, MaxTime: 10}}},
+			{lset: labels.FromStrings("__name__", "b"), chks: []chunks.Meta{{MinTime: 50, MaxTime: 60}}},
+		},
+	}
+
+	q, err := b.ChunkQuerierForRange(0, 100, nil)
+	ok(t, err)
+	css, err := q.SelectChunks(labels.NewEqualMatcher("__name__", "a"))
+	ok(t, err)
+	equals(t, []labels.Labels{labels.FromStrings("__name__", "a")}, chunkSeriesSetLabels(t, css))
+
+	// Narrowing the range past series "a"'s only chunk excludes it even
+	// though its label set still matches.
+	q, err = b.ChunkQuerierForRange(20, 100, nil)
+	ok(t, err)
+	css, err = q.SelectChunks(labels.NewEqualMatcher("__name__", "a"))
+	ok(t, err)
+	equals(t, 0, len(chunkSeriesSetLabels(t, css)))
+}
+
+// TestDBChunkQuerier_MergesHeadAndBlocks verifies that DB.ChunkQuerier
+// merges series held by the head with series held by persisted blocks,
+// combining a series split across both into one ChunkSeries sorted by
+// time.
+func TestDBChunkQuerier_MergesHeadAndBlocks(t *testing.T) {
+	db, close := openTestDB(t, nil)
+	defer close()
+
+	lset := labels.FromStrings("__name__", "a")
+	db.blocks = []*Block{
+		{
+			dir:  filepath.Join(db.Dir(), "block1"),
+			meta: BlockMeta{MinTime: 0, MaxTime: 100},
+			series: []seriesChunks{
+				{lset: lset, chks: []chunks.Meta{{MinTime: 0, MaxTime: 10}}},
+			},
+		},
+	}
+	db.head.series = []seriesChunks{
+		{lset: lset, chks: []chunks.Meta{{MinTime: 20, MaxTime: 30}}},
+		{lset: labels.FromStrings("__name__", "b"), chks: []chunks.Meta{{MinTime: 20, MaxTime: 30}}},
+	}
+
+	q, err := db.ChunkQuerier(context.Background(), 0, 100)
+	ok(t, err)
+	css, err := q.SelectChunks(labels.NewEqualMatcher("__name__", "a"))
+	ok(t, err)
+
+	assert(t, css.Next(), "expected a merged series for label set a")
+	merged := css.At()
+	equals(t, lset, merged.Labels())
+	equals(t, []chunks.Meta{{MinTime: 0, MaxTime: 10}, {MinTime: 20, MaxTime: 30}}, merged.Chunks())
+	assert(t, !css.Next(), "expected no further series")
+}
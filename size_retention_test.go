@@ -0,0 +1,95 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oklog/ulid"
+)
+
+// createBlockOfSize writes a real index and chunks/000001 file under dir
+// sized so that blockDirSize(dir) reports exactly sizeBytes, and returns
+// the *Block wrapping it. Blocks written by the compactor have sizes that
+// depend on the encoded series data, so size-retention tests write files
+// of a chosen size directly instead.
+func createBlockOfSize(tb testing.TB, dir string, meta BlockMeta, sizeBytes int64) *Block {
+	ok(tb, os.MkdirAll(filepath.Join(dir, "chunks"), 0777))
+	ok(tb, ioutil.WriteFile(filepath.Join(dir, "index"), make([]byte, sizeBytes), 0666))
+	ok(tb, ioutil.WriteFile(filepath.Join(dir, "chunks", "000001"), nil, 0666))
+	return &Block{dir: dir, meta: meta}
+}
+
+// TestSizeRetention verifies that beyondSizeRetention evicts the oldest
+// blocks first until the total on-disk size is under Options.MaxBytes.
+func TestSizeRetention(t *testing.T) {
+	dir, close := newTempDir(t)
+	defer close()
+
+	db, err := Open(dir, nil, nil, &Options{MaxBytes: 0})
+	ok(t, err)
+	defer db.Close()
+
+	const blockSizeBytes = 1000
+	var blocks []*Block
+	for i := 0; i < 4; i++ {
+		mint := int64(i) * 1000
+		maxt := mint + 1000
+		meta := BlockMeta{ULID: ulid.MustNew(uint64(i)+1, nil), MinTime: mint, MaxTime: maxt}
+		blockDir := filepath.Join(dir, "blocks", meta.ULID.String())
+		blocks = append(blocks, createBlockOfSize(t, blockDir, meta, blockSizeBytes))
+	}
+	db.blocks = blocks
+
+	oneBlockSize := db.blockSize(blocks[0])
+	assert(t, oneBlockSize > 0, "expected non-zero block size")
+	db.opts.MaxBytes = oneBlockSize*2 + 1
+
+	deletable := db.beyondSizeRetention(db.blocks)
+	equals(t, 2, len(deletable))
+
+	// The two oldest blocks (index 0 and 1) must be the ones evicted.
+	_, ok0 := deletable[blocks[0].meta.ULID]
+	_, ok1 := deletable[blocks[1].meta.ULID]
+	assert(t, ok0 && ok1, "expected the two oldest blocks to be marked for deletion")
+}
+
+// TestSizeRetention_CachedSize verifies that the block size is only
+// computed once and reused on subsequent retention passes.
+func TestSizeRetention_CachedSize(t *testing.T) {
+	dir, close := newTempDir(t)
+	defer close()
+
+	db, err := Open(dir, nil, nil, &Options{MaxBytes: 1 << 30})
+	ok(t, err)
+	defer db.Close()
+
+	meta := BlockMeta{ULID: ulid.MustNew(1, nil), MinTime: 0, MaxTime: 1000}
+	b := createBlockOfSize(t, filepath.Join(dir, "blocks", meta.ULID.String()), meta, 1234)
+
+	sz1 := db.blockSize(b)
+	equals(t, int64(1234), sz1)
+
+	// Mutate the on-disk file after the first call: if blockSize re-walked
+	// the directory instead of using the cache, this would change the
+	// reported size.
+	ok(t, ioutil.WriteFile(filepath.Join(b.Dir(), "index"), make([]byte, 1), 0666))
+
+	sz2 := db.blockSize(b)
+	equals(t, sz1, sz2)
+	equals(t, 1, len(db.sizeCache))
+}
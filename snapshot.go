@@ -0,0 +1,87 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrOutOfBounds is returned by an Appender when a sample's timestamp is
+// below the minimum valid time for the DB, i.e. it falls within a time
+// range already owned by a persisted block.
+var ErrOutOfBounds = fmt.Errorf("tsdb: sample timestamp out of bounds")
+
+// Snapshot hard-links all persisted block files into dir. If withHead is
+// true, it additionally flushes the in-memory head into a new block
+// written under dir, bounded to the head's actual [mint, maxt) rather
+// than the default block-range grid: snapshotting mid-range and then
+// letting the next compaction write another block on the same grid slot
+// would otherwise produce two overlapping blocks.
+func (db *DB) Snapshot(dir string, withHead bool) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("create snapshot dir: %w", err)
+	}
+
+	db.mtx.RLock()
+	blocks := db.blocks[:]
+	db.mtx.RUnlock()
+
+	for _, b := range blocks {
+		if err := hardLinkBlock(b.Dir(), filepath.Join(dir, b.Meta().ULID.String())); err != nil {
+			return fmt.Errorf("snapshot block %s: %w", b.Meta().ULID, err)
+		}
+	}
+
+	if !withHead {
+		return nil
+	}
+
+	db.head.mtx.RLock()
+	empty := db.head.minTime > db.head.maxTime
+	db.head.mtx.RUnlock()
+	if empty {
+		// Nothing buffered in the head; nothing to flush.
+		return nil
+	}
+	mint, maxt := db.head.MinTime(), db.head.MaxTime()
+
+	if _, err := db.compactor.Write(dir, db.head, mint, maxt+1, nil); err != nil {
+		return fmt.Errorf("snapshot head: %w", err)
+	}
+	return nil
+}
+
+// hardLinkBlock hard-links every file under src into dst, preserving
+// block file names. Both sides must be on the same filesystem.
+func hardLinkBlock(src, dst string) error {
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		return err
+	}
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		return os.Link(path, target)
+	})
+}
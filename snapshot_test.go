@@ -0,0 +1,132 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestHeadAppender_RejectsBelowMinValidTime(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 2*60*60*1000)
+	ok(t, err)
+	ok(t, h.Init(100))
+
+	app := h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "b"), 50, 1)
+	equals(t, ErrOutOfBounds, err)
+
+	_, err = app.Add(labels.FromStrings("a", "b"), 150, 1)
+	ok(t, err)
+}
+
+func TestDB_Snapshot(t *testing.T) {
+	dir, close := newTempDir(t)
+	defer close()
+
+	db, err := Open(dir, nil, nil, nil)
+	ok(t, err)
+	defer db.Close()
+
+	snapDir, closeSnap := newTempDir(t)
+	defer closeSnap()
+
+	ok(t, db.Snapshot(snapDir, true))
+}
+
+// TestDB_Snapshot_WithHeadData verifies that Snapshot doesn't panic when
+// the head actually has buffered samples, i.e. db.compactor is wired up
+// by Open and reached by the withHead branch.
+func TestDB_Snapshot_WithHeadData(t *testing.T) {
+	dir, close := newTempDir(t)
+	defer close()
+
+	db, err := Open(dir, nil, nil, nil)
+	ok(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("a", "b"), 0, 1)
+	ok(t, err)
+	ok(t, app.Commit())
+
+	snapDir, closeSnap := newTempDir(t)
+	defer closeSnap()
+
+	ok(t, db.Snapshot(snapDir, true))
+}
+
+// TestDB_SnapshotAndReopen verifies that a reopened DB, as produced by
+// testutil.SnapshotAndReopen, comes back up with its head initialized past
+// the snapshotted data (rather than left unset until the first write) and
+// that the snapshotted series/samples actually round-trip through the new
+// block the snapshot flushed.
+func TestDB_SnapshotAndReopen(t *testing.T) {
+	dir, close := newTempDir(t)
+	defer close()
+
+	db, err := Open(dir, nil, nil, nil)
+	ok(t, err)
+	defer db.Close()
+
+	lset := labels.FromStrings("a", "b")
+	app := db.Appender()
+	_, err = app.Add(lset, 0, 1)
+	ok(t, err)
+	_, err = app.Add(lset, 1, 2)
+	ok(t, err)
+	ok(t, app.Commit())
+
+	reopened := snapshotAndReopen(t, db)
+	defer reopened.Close()
+
+	equals(t, int64(2), reopened.head.minValidTime)
+
+	q, err := reopened.Querier(context.Background(), 0, 100)
+	ok(t, err)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewEqualMatcher("a", "b"))
+	ok(t, err)
+	assert(t, ss.Next(), "expected the snapshotted series to round-trip")
+
+	it := ss.At().Iterator()
+	var gotT []int64
+	var gotV []float64
+	for it.Next() {
+		ts, v := it.At()
+		gotT = append(gotT, ts)
+		gotV = append(gotV, v)
+	}
+	ok(t, it.Err())
+	equals(t, []int64{0, 1}, gotT)
+	equals(t, []float64{1, 2}, gotV)
+
+	assert(t, !ss.Next(), "expected exactly one series")
+}
+
+// TestMinValidTimeForBlocks verifies the boundary DB.Open passes to
+// Head.Init on restart: the maxt of the most recently persisted block, or
+// 0 if none are persisted yet.
+func TestMinValidTimeForBlocks(t *testing.T) {
+	equals(t, int64(0), minValidTimeForBlocks(nil))
+
+	blocks := []*Block{
+		{meta: BlockMeta{MinTime: 0, MaxTime: 100}},
+		{meta: BlockMeta{MinTime: 100, MaxTime: 250}},
+	}
+	equals(t, int64(250), minValidTimeForBlocks(blocks))
+}
@@ -1,21 +1,45 @@
 package testutil
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/labels"
 	"github.com/prometheus/tsdb/tsdbutil"
 )
 
+// staleNaN is a NaN with Prometheus' stale-marker bit pattern set, so a
+// stale marker generated here round-trips through any staleness-aware
+// consumer the same way a real scrape-miss marker would. tsdbutil has no
+// such constant of its own (staleness is a Prometheus-level concept, not a
+// tsdb-level one), so it's defined locally instead of invented as a
+// tsdbutil symbol that doesn't exist.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// NewTempDir creates a temporary directory for tests that need one on its
+// own, without opening a DB in it (e.g. a Snapshot target).
+func NewTempDir(t testing.TB) (dir string, close func()) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	Ok(t, err)
+
+	return tmpdir, func() {
+		Ok(t, os.RemoveAll(tmpdir))
+	}
+}
+
 // OpenTestDB opens a test Database
 func OpenTestDB(t testing.TB, opts *tsdb.Options) (db *tsdb.DB, close func()) {
 	tmpdir, err := ioutil.TempDir("", "test")
@@ -30,9 +54,110 @@ func OpenTestDB(t testing.TB, opts *tsdb.Options) (db *tsdb.DB, close func()) {
 	}
 }
 
+// SnapshotAndReopen snapshots db (including its head) into a fresh temp
+// dir and opens the snapshot as a new *tsdb.DB, for tests that assert
+// round-trip equality of all series across a Snapshot/restart cycle.
+// Callers are responsible for closing the returned DB.
+func SnapshotAndReopen(t testing.TB, db *tsdb.DB) *tsdb.DB {
+	snapDir, err := ioutil.TempDir("", "test-snapshot")
+	Ok(t, err)
+
+	Ok(t, db.Snapshot(snapDir, true))
+
+	reopened, err := tsdb.Open(snapDir, nil, nil, nil)
+	Ok(t, err)
+	return reopened
+}
+
+// chunkSeries is a tsdb.ChunkSeries backed by a fixed, caller-provided
+// list of chunks.Meta, for tests of the chunk-level query path that don't
+// need a real block on disk.
+type chunkSeries struct {
+	lset labels.Labels
+	chks []chunks.Meta
+}
+
+func (s *chunkSeries) Labels() labels.Labels  { return s.lset }
+func (s *chunkSeries) Chunks() []chunks.Meta  { return s.chks }
+
+type chunkSeriesSet struct {
+	series []*chunkSeries
+	idx    int
+}
+
+func (s *chunkSeriesSet) Next() bool {
+	s.idx++
+	return s.idx < len(s.series)
+}
+
+func (s *chunkSeriesSet) At() tsdb.ChunkSeries {
+	return s.series[s.idx]
+}
+
+func (s *chunkSeriesSet) Err() error { return nil }
+
+// CreateChunkSeriesSet builds a tsdb.ChunkSeriesSet directly from a
+// label-set -> chunks.Meta mapping, for tests that want to exercise
+// ChunkQuerier consumers (e.g. a remote-read server) without paying for a
+// full CreateBlock + compaction + decode round trip.
+func CreateChunkSeriesSet(tb testing.TB, series map[string][]chunks.Meta) tsdb.ChunkSeriesSet {
+	set := &chunkSeriesSet{idx: -1}
+	for lsetStr, chks := range series {
+		l, err := parsePromSeriesLine(lsetStr)
+		Ok(tb, err)
+		set.series = append(set.series, &chunkSeries{lset: l, chks: chks})
+	}
+	return set
+}
+
+// EqualsChunkBytes asserts that two chunks.Meta encode identical byte
+// streams, for round-trip tests that compare chunks.Meta produced by two
+// different code paths (e.g. before/after an encode-decode-reencode
+// cycle) without caring about their minTime/maxTime/ref metadata.
+func EqualsChunkBytes(tb testing.TB, want, got chunks.Meta) {
+	Equals(tb, want.Chunk.Bytes(), got.Chunk.Bytes())
+}
+
+// OpenTestMultiDB opens a test MultiDB rooted at a fresh temp dir, with
+// one subdirectory reserved per tenant in tenants. The returned close func
+// closes the MultiDB (and with it every open per-tenant DB) and then
+// removes the temp dir.
+func OpenTestMultiDB(t testing.TB, opts tsdb.MultiDBOptions, tenants []string) (m *tsdb.MultiDB, close func()) {
+	tmpdir, err := ioutil.TempDir("", "test-multidb")
+	Ok(t, err)
+	for _, tenant := range tenants {
+		Ok(t, os.MkdirAll(filepath.Join(tmpdir, tenant), 0777))
+	}
+
+	m, err = tsdb.OpenMultiDB(tmpdir, nil, nil, opts)
+	Ok(t, err)
+
+	return m, func() {
+		Ok(t, m.Close())
+		Ok(t, os.RemoveAll(tmpdir))
+	}
+}
+
+// CreateBlockForTenant creates a block for the given tenant under root,
+// mirroring the on-disk layout MultiDB expects (root/tenant/<ULID>), and
+// returns the block's dir.
+func CreateBlockForTenant(tb testing.TB, root, tenant string, series []tsdb.Series) string {
+	return CreateBlock(tb, filepath.Join(root, tenant), series)
+}
+
+// SeriesExemplars maps a series' index within the slice passed to
+// CreateBlock/createHead to the exemplars that should be attached to it,
+// keyed by the index of the sample (within that series' iterator) the
+// exemplar belongs to.
+type SeriesExemplars map[int]map[int]tsdb.Exemplar
+
 // CreateBlock creates a block with given set of series and returns its dir.
-func CreateBlock(tb testing.TB, dir string, series []tsdb.Series) string {
-	head := createHead(tb, series)
+// exemplars is optional; when given, each exemplar is passed to
+// AppendExemplar as its sample is appended. The head built by createHead
+// has no exemplar storage, so AppendExemplar discards them, and the
+// written block holds no exemplars.
+func CreateBlock(tb testing.TB, dir string, series []tsdb.Series, exemplars ...SeriesExemplars) string {
+	head := createHead(tb, series, exemplars...)
 	compactor, err := tsdb.NewLeveledCompactor(context.Background(), nil, log.NewNopLogger(), []int64{1000000}, nil)
 	Ok(tb, err)
 
@@ -45,25 +170,35 @@ func CreateBlock(tb testing.TB, dir string, series []tsdb.Series) string {
 	return filepath.Join(dir, ulid.String())
 }
 
-func createHead(tb testing.TB, series []tsdb.Series) *tsdb.Head {
+func createHead(tb testing.TB, series []tsdb.Series, exemplars ...SeriesExemplars) *tsdb.Head {
 	head, err := tsdb.NewHead(nil, nil, nil, 2*60*60*1000)
 	Ok(tb, err)
 	defer head.Close()
 
+	var se SeriesExemplars
+	if len(exemplars) > 0 {
+		se = exemplars[0]
+	}
+
 	app := head.Appender()
-	for _, s := range series {
+	for si, s := range series {
 		ref := uint64(0)
 		it := s.Iterator()
-		for it.Next() {
+		for sampleIdx := 0; it.Next(); sampleIdx++ {
 			t, v := it.At()
 			if ref != 0 {
 				err := app.AddFast(ref, t, v)
 				if err == nil {
-					continue
+					goto appendExemplar
 				}
 			}
 			ref, err = app.Add(s.Labels(), t, v)
 			Ok(tb, err)
+
+		appendExemplar:
+			if e, ok := se[si][sampleIdx]; ok {
+				Ok(tb, app.AppendExemplar(ref, s.Labels(), e))
+			}
 		}
 		Ok(tb, it.Err())
 	}
@@ -90,29 +225,231 @@ func (s sample) V() float64 {
 	return s.v
 }
 
-// GenSeries generates series with a given number of labels and values.
-func GenSeries(totalSeries, labelCount int, mint, maxt int64) []tsdb.Series {
+// GenSeriesOptions controls how GenSeries and GenSeriesFromLabels generate
+// their samples. The zero value is a valid, fully deterministic
+// configuration: one sample per unit of time in [mint, maxt), in order,
+// with no staleness markers or label churn.
+type GenSeriesOptions struct {
+	// Seed seeds the random source used for sample values and, if
+	// OutOfOrderFraction > 0, for deciding which timestamps to reorder.
+	// The same Seed always produces the same series.
+	Seed int64
+
+	// SamplesPerSeries caps the number of samples generated per series. A
+	// value <= 0 means "one sample per ScrapeInterval in [mint, maxt)",
+	// which with the default ScrapeInterval of 1 matches the historical
+	// behavior of GenSeries.
+	SamplesPerSeries int
+
+	// ScrapeInterval is the spacing between sample timestamps. A value
+	// <= 0 defaults to 1.
+	ScrapeInterval int64
+
+	// OutOfOrderFraction is the fraction (0..1) of samples whose
+	// timestamp is shifted backwards within the preceding scrape
+	// interval, to exercise out-of-order ingestion paths.
+	OutOfOrderFraction float64
+
+	// StaleMarkers, when true, appends a stale marker (value math.NaN
+	// with the stale bit set via staleNaN) after every series' last
+	// sample.
+	StaleMarkers bool
+
+	// Churn is the number of additional, otherwise-identical label sets
+	// generated per requested series, simulating label-set turnover
+	// between chunks (e.g. a pod being rescheduled).
+	Churn int
+}
+
+func (o GenSeriesOptions) withDefaults() GenSeriesOptions {
+	if o.ScrapeInterval <= 0 {
+		o.ScrapeInterval = 1
+	}
+	return o
+}
+
+// GenSeries generates series with a given number of labels and values. The
+// optional GenSeriesOptions controls determinism (Seed), sample density,
+// and out-of-order/stale-marker behavior; omitting it reproduces the
+// historical one-sample-per-unit-time behavior with Seed 0.
+func GenSeries(totalSeries, labelCount int, mint, maxt int64, opts ...GenSeriesOptions) []tsdb.Series {
 	if totalSeries == 0 || labelCount == 0 {
 		return nil
 	}
 
-	series := make([]tsdb.Series, totalSeries)
-
+	lbls := make([]labels.Labels, 0, totalSeries)
 	for i := 0; i < totalSeries; i++ {
-		lbls := make(map[string]string, labelCount)
-		lbls[defaultLabelName] = strconv.Itoa(i)
-		for j := 1; len(lbls) < labelCount; j++ {
-			lbls[defaultLabelName+strconv.Itoa(j)] = defaultLabelValue + strconv.Itoa(j)
+		m := make(map[string]string, labelCount)
+		m[defaultLabelName] = strconv.Itoa(i)
+		for j := 1; len(m) < labelCount; j++ {
+			m[defaultLabelName+strconv.Itoa(j)] = defaultLabelValue + strconv.Itoa(j)
 		}
-		samples := make([]tsdbutil.Sample, 0, maxt-mint+1)
-		for t := mint; t < maxt; t++ {
-			samples = append(samples, sample{t: t, v: rand.Float64()})
+		lbls = append(lbls, labels.FromMap(m))
+	}
+
+	var o GenSeriesOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	return genSeriesFromLabels(lbls, mint, maxt, o)
+}
+
+// GenSeriesFromLabels generates one tsdb.Series per entry in lbls, driven
+// by opts, so tests can exercise real-world label distributions (e.g.
+// loaded via ReadPrometheusLabels) instead of the synthetic labels
+// GenSeries produces. The time range is derived from
+// opts.SamplesPerSeries and opts.ScrapeInterval, starting at t=0; a
+// SamplesPerSeries of 0 defaults to defaultSamplesPerSeries.
+func GenSeriesFromLabels(lbls []labels.Labels, opts GenSeriesOptions) []tsdb.Series {
+	n := opts.SamplesPerSeries
+	if n <= 0 {
+		n = defaultSamplesPerSeries
+	}
+	scrape := opts.ScrapeInterval
+	if scrape <= 0 {
+		scrape = 1
+	}
+	return genSeriesFromLabels(lbls, 0, int64(n)*scrape, opts)
+}
+
+const defaultSamplesPerSeries = 120
+
+func genSeriesFromLabels(lbls []labels.Labels, mint, maxt int64, opts GenSeriesOptions) []tsdb.Series {
+	opts = opts.withDefaults()
+	rnd := rand.New(rand.NewSource(opts.Seed))
+
+	churn := opts.Churn
+	if churn < 0 {
+		churn = 0
+	}
+
+	series := make([]tsdb.Series, 0, len(lbls)*(1+churn))
+	for _, l := range lbls {
+		series = append(series, newSeries(l.Map(), genSamples(mint, maxt, opts, rnd)))
+
+		for c := 0; c < churn; c++ {
+			m := l.Map()
+			m["churn"] = strconv.Itoa(c)
+			series = append(series, newSeries(m, genSamples(mint, maxt, opts, rnd)))
 		}
-		series[i] = newSeries(lbls, samples)
 	}
 	return series
 }
 
+func genSamples(mint, maxt int64, opts GenSeriesOptions, rnd *rand.Rand) []tsdbutil.Sample {
+	n := int((maxt - mint) / opts.ScrapeInterval)
+	if opts.SamplesPerSeries > 0 && opts.SamplesPerSeries < n {
+		n = opts.SamplesPerSeries
+	}
+
+	samples := make([]tsdbutil.Sample, 0, n+1)
+	var prevT int64
+	for i := 0; i < n; i++ {
+		t := mint + int64(i)*opts.ScrapeInterval
+		if i > 0 && opts.OutOfOrderFraction > 0 && rnd.Float64() < opts.OutOfOrderFraction {
+			// Shift backwards relative to the previously emitted
+			// timestamp, not this sample's own grid slot: the grid slot
+			// is already >= prevT+1, so a shift bounded by the scrape
+			// interval and computed against it (as opposed to against
+			// t) can land anywhere in [prevT-scrapeInterval, prevT-1],
+			// guaranteeing a timestamp genuinely out of order relative
+			// to the sample before it.
+			t = prevT - 1 - int64(rnd.Float64()*float64(opts.ScrapeInterval))
+		}
+		samples = append(samples, sample{t: t, v: rnd.Float64()})
+		prevT = t
+	}
+	if opts.StaleMarkers && len(samples) > 0 {
+		last := samples[len(samples)-1].T()
+		samples = append(samples, sample{t: last + opts.ScrapeInterval, v: staleNaN})
+	}
+	return samples
+}
+
+// ReadPrometheusLabels reads up to n label sets from a text file at path,
+// one Prometheus exposition-format series per line (e.g.
+// `http_requests_total{method="GET",code="200"}`), for tests that want to
+// drive GenSeriesFromLabels with real-world label distributions.
+func ReadPrometheusLabels(path string, n int) ([]labels.Labels, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []labels.Labels
+	sc := bufio.NewScanner(f)
+	for sc.Scan() && len(out) < n {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		l, err := parsePromSeriesLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("parsing line %q: %w", line, err)
+		}
+		out = append(out, l)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// parsePromSeriesLine parses a single `name{k="v",...}` series
+// description into a labels.Labels, without requiring a value or
+// timestamp (unlike the full exposition-format parser).
+func parsePromSeriesLine(line string) (labels.Labels, error) {
+	m := map[string]string{}
+
+	name := line
+	if i := strings.IndexByte(line, '{'); i >= 0 {
+		name = line[:i]
+		if !strings.HasSuffix(line, "}") {
+			return nil, fmt.Errorf("missing closing brace")
+		}
+		body := line[i+1 : len(line)-1]
+		for _, pair := range strings.Split(body, ",") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("malformed label pair %q", pair)
+			}
+			m[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	m["__name__"] = name
+	return labels.FromMap(m), nil
+}
+
+// GenSeriesWithExemplars behaves like GenSeries but additionally attaches
+// an exemplar to every exemplarEvery-th sample of every series, so tests
+// can exercise exemplar storage without hand-building SeriesExemplars.
+func GenSeriesWithExemplars(totalSeries, labelCount int, mint, maxt int64, exemplarEvery int) ([]tsdb.Series, SeriesExemplars) {
+	series := GenSeries(totalSeries, labelCount, mint, maxt)
+	if exemplarEvery <= 0 {
+		return series, nil
+	}
+
+	se := SeriesExemplars{}
+	for si := range series {
+		sampleCount := int(maxt - mint)
+		perSeries := map[int]tsdb.Exemplar{}
+		for sampleIdx := 0; sampleIdx < sampleCount; sampleIdx += exemplarEvery {
+			perSeries[sampleIdx] = tsdb.Exemplar{
+				Labels: labels.FromMap(map[string]string{"traceID": strconv.Itoa(si) + "-" + strconv.Itoa(sampleIdx)}),
+				Value:  rand.Float64(),
+				Ts:     mint + int64(sampleIdx),
+			}
+		}
+		se[si] = perSeries
+	}
+	return series, se
+}
+
 type mockSeries struct {
 	labels   func() labels.Labels
 	iterator func() tsdb.SeriesIterator
@@ -0,0 +1,42 @@
+package testutil
+
+import "testing"
+
+func TestGenSeries_Deterministic(t *testing.T) {
+	opts := GenSeriesOptions{Seed: 42, OutOfOrderFraction: 0.2, ScrapeInterval: 5}
+
+	a := GenSeries(3, 2, 0, 100, opts)
+	b := GenSeries(3, 2, 0, 100, opts)
+
+	for i := range a {
+		itA, itB := a[i].Iterator(), b[i].Iterator()
+		for itA.Next() {
+			Assert(t, itB.Next(), "series %d: b ran out of samples before a", i)
+			ta, va := itA.At()
+			tb, vb := itB.At()
+			Equals(t, ta, tb)
+			Equals(t, va, vb)
+		}
+		Assert(t, !itB.Next(), "series %d: b has more samples than a", i)
+	}
+}
+
+func TestGenSeries_OutOfOrder(t *testing.T) {
+	opts := GenSeriesOptions{Seed: 7, ScrapeInterval: 10, OutOfOrderFraction: 1}
+
+	series := GenSeries(1, 1, 0, 200, opts)
+	it := series[0].Iterator()
+
+	var sawOutOfOrder bool
+	var prev int64
+	first := true
+	for it.Next() {
+		ts, _ := it.At()
+		if !first && ts < prev {
+			sawOutOfOrder = true
+		}
+		prev = ts
+		first = false
+	}
+	Assert(t, sawOutOfOrder, "expected at least one out-of-order sample with OutOfOrderFraction=1")
+}